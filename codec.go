@@ -0,0 +1,240 @@
+package confy
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ConfigCodec reads and writes config files in a particular format, allowing
+// formats like YAML to be added without modifying this package.
+//
+// If a ConfigCodec also has a method Extension() string, the returned
+// extension, e.g. ".yaml", is used for the default config file instead of
+// .conf.
+type ConfigCodec interface {
+	// Decode reads the keys and values of a config file from r. The values
+	// must be in the string form accepted by flag.Value.Set.
+	Decode(r io.Reader) (map[string]string, error)
+	// Encode writes the flags and obsolete keys not matching any flag to w.
+	Encode(w io.Writer, flags []flag.Flag, obsolete map[string]string) error
+}
+
+// TextCodec is the default KEY=VALUE format of the config file, see Parse.
+// Parse and ParseWith use it with additional support for preserving comments
+// and the exact text of values.
+var TextCodec ConfigCodec = textCodec{}
+
+// ParseCodec is like Parse but reads and writes the config file with c. Keys
+// are matched to the flags case-insensitively and keys not matching any flag
+// are passed to c.Encode as obsolete, or reported as errors in strict mode.
+func ParseCodec(appName string, c ConfigCodec) error {
+	return ParseWith(appName, WithCodec(c))
+}
+
+// WithCodec reads and writes the config file with c instead of TextCodec,
+// see ParseCodec.
+func WithCodec(c ConfigCodec) Option {
+	return func(o *options) {
+		if _, ok := c.(textCodec); ok {
+			o.format = textFormat{}
+			return
+		} else if _, ok := c.(dotenvCodec); ok {
+			o.format = dotenvFormat{codecFormat{c}}
+			return
+		}
+		o.format = codecFormat{c}
+	}
+}
+
+// fileFormat reads and writes config files in a particular syntax.
+type fileFormat interface {
+	// ext returns the extension of the default config file
+	ext() string
+	// parse applies the config file read from r to the flags
+	parse(o *options, r io.Reader) (*config, error)
+	// save writes the flags and obsolete keys of conf to w
+	save(o *options, w io.Writer, conf *config) error
+}
+
+// textFormat is the default KEY=VALUE format.
+type textFormat struct{}
+
+func (textFormat) ext() string {
+	return ".ini"
+}
+
+func (textFormat) parse(o *options, r io.Reader) (*config, error) {
+	if len(o.migrations) > 0 {
+		return parseMigrated(o, r)
+	}
+	return parseConfig(o, r)
+}
+
+func (textFormat) save(o *options, w io.Writer, conf *config) error {
+	if header := o.headerComment(); header != "" {
+		fmt.Fprintln(w, header)
+	}
+	saveConfig(o, w, conf)
+	return nil
+}
+
+// headerComment returns the comment lines written at the top of the config
+// file, see WithHeader and WithComment.
+func (o *options) headerComment() string {
+	text := fmt.Sprintf(configHeader, o.appName, o.commentPrefix, o.writeSeparator())
+	if o.unset != "" {
+		text += fmt.Sprintf("\nA VALUE of %s resets the KEY to its default, e.g. one set by a base file.", o.unset)
+	}
+	header := commentLines(o.commentPrefix, text)
+	if o.header != nil {
+		header = ""
+		if text := strings.TrimRight(*o.header, "\n"); text != "" {
+			lines := strings.Split(text, "\n")
+			for i, line := range lines {
+				if !strings.HasPrefix(line, o.commentPrefix) {
+					lines[i] = commentLines(o.commentPrefix, line)
+				}
+			}
+			header = strings.Join(lines, "\n")
+		}
+	}
+	if o.comment != "" {
+		if header != "" {
+			header += "\n" + o.commentPrefix + "\n"
+		}
+		header += commentLines(o.commentPrefix, o.comment)
+	}
+	return header
+}
+
+// codecFormat adapts a ConfigCodec to a fileFormat.
+type codecFormat struct {
+	c ConfigCodec
+}
+
+func (f codecFormat) ext() string {
+	if e, ok := f.c.(interface{ Extension() string }); ok {
+		return e.Extension()
+	}
+	return ".conf"
+}
+
+func (f codecFormat) parse(o *options, r io.Reader) (*config, error) {
+	values, err := f.decode(o, r)
+	if err != nil {
+		return nil, err
+	}
+	return applyDecoded(o, values)
+}
+
+// limitedDecoder is implemented by the codecs of this package, which read
+// lines of up to max bytes, see WithMaxLineLength.
+type limitedDecoder interface {
+	decodeLimited(r io.Reader, max int) (map[string]string, error)
+}
+
+// decode reads the keys and values of the config file from r with the line
+// length limit of o if the codec supports it.
+func (f codecFormat) decode(o *options, r io.Reader) (map[string]string, error) {
+	if d, ok := f.c.(limitedDecoder); ok {
+		return d.decodeLimited(r, o.maxLine)
+	}
+	return f.c.Decode(r)
+}
+
+// applyDecoded applies the values decoded by a codec to the flags, migrating
+// them first, see WithMigration.
+func applyDecoded(o *options, values map[string]string) (*config, error) {
+	version := 0
+	var err error
+	if len(o.migrations) > 0 {
+		if version, values, err = migrateValues(o, values); err != nil {
+			return nil, err
+		}
+	}
+	conf, err := applyValues(o, values)
+	conf.version = version
+	return conf, err
+}
+
+func (f codecFormat) save(o *options, w io.Writer, conf *config) error {
+	if conf == nil {
+		conf = &config{}
+	}
+	var flags []flag.Flag
+	for _, f := range savedFlags(o) {
+		// flags set by base files only must not override them
+		if _, inFile := conf.raw[f.Name]; !o.inherited[f.Name] || inFile {
+			flags = append(flags, f)
+		}
+	}
+	if v := o.fileVersion(conf); v > 0 {
+		flags = append([]flag.Flag{{Name: versionKey, Usage: versionUsage, Value: fixedValue(strconv.Itoa(v)), DefValue: "0"}}, flags...)
+	}
+	for i := range flags {
+		if !o.secrets[flags[i].Name] {
+			continue
+		}
+		// codecs never see the values of secret flags
+		flags[i].Value = fixedValue(conf.secretText(&flags[i]))
+		if flags[i].DefValue != "" {
+			flags[i].DefValue = secretPlaceholder
+		}
+	}
+	return f.c.Encode(w, flags, conf.obsolete)
+}
+
+// fixedValue is a flag.Value which cannot be changed.
+type fixedValue string
+
+func (v fixedValue) String() string {
+	return string(v)
+}
+
+func (v fixedValue) Set(string) error {
+	return fmt.Errorf("value cannot be changed")
+}
+
+// textCodec implements TextCodec.
+type textCodec struct{}
+
+func (textCodec) Extension() string {
+	return ".ini"
+}
+
+// Decode parses the config file without any flags, so all keys end up as
+// obsolete. Includes are reported as errors, as r has no path to resolve them
+// against.
+func (textCodec) Decode(r io.Reader) (map[string]string, error) {
+	o := newOptions("", []Option{WithFlagSet(flag.NewFlagSet("", flag.ContinueOnError)), WithWriter(io.Discard)})
+	conf, err := parseConfigFile(o, r, &includes{disabled: true}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return conf.obsolete, nil
+}
+
+func (textCodec) Encode(w io.Writer, flags []flag.Flag, obsolete map[string]string) error {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	for _, f := range flags {
+		fs.Var(f.Value, f.Name, f.Usage)
+		fs.Lookup(f.Name).DefValue = f.DefValue
+	}
+	saveConfig(newOptions("", []Option{WithFlagSet(fs)}), w, &config{obsolete: obsolete})
+	return nil
+}
+
+// withDeprecated adds the keys of the deprecated section of a codec's file to
+// values. They are applied as well, in case flags were added for them again,
+// but values takes precedence.
+func withDeprecated(values, deprecated map[string]string) map[string]string {
+	for key, val := range deprecated {
+		if _, ok := values[key]; !ok {
+			values[key] = val
+		}
+	}
+	return values
+}
@@ -0,0 +1,111 @@
+package confy
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// lineCodec is a minimal ConfigCodec writing one "key value" pair per line.
+type lineCodec struct{}
+
+func (lineCodec) Decode(r io.Reader) (map[string]string, error) {
+	b, err := io.ReadAll(r)
+	values := make(map[string]string)
+	for _, line := range strings.Split(string(b), "\n") {
+		if key, val, ok := strings.Cut(line, " "); ok {
+			values[key] = val
+		}
+	}
+	return values, err
+}
+
+func (lineCodec) Encode(w io.Writer, flags []flag.Flag, obsolete map[string]string) error {
+	for _, f := range flags {
+		fmt.Fprintf(w, "%s %s\n", f.Name, f.Value)
+	}
+	for _, key := range sortedKeys(obsolete) {
+		fmt.Fprintf(w, "%s %s\n", key, obsolete[key])
+	}
+	return nil
+}
+
+func TestParseCodec(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	f, err := ioutil.TempFile("", "confy_testcodec")
+	if err != nil {
+		t.Fatalf("failed to create tempfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, "Port 8080\nold 1\ntoken abc\n")
+	f.Close()
+	os.Setenv("CONFY_CODECINF0", f.Name())
+	defer os.Unsetenv("CONFY_CODECINF0")
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	port := flag.Int("port", 80, "port")
+	secret := flag.String("secret", "default", "secret")
+	token := flag.String("token", "", "token")
+	if err := ParseWith("confy_codec", WithCodec(lineCodec{}), WithSecret("secret", "token"), WithUpdateWarning(false)); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *port != 8080 || *secret != "default" || *token != "abc" {
+		t.Errorf("unexpected values: %d, %q, %q", *port, *secret, *token)
+	}
+	want := "port 8080\nsecret ****\ntoken abc\nold 1\n"
+	if b, err := ioutil.ReadFile(f.Name()); err != nil || string(b) != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, b)
+	}
+}
+
+func TestTextCodec(t *testing.T) {
+	values, err := TextCodec.Decode(bytes.NewBufferString(`
+# comment
+port=8080
+[db]
+host = "localhost" # inline`))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if len(values) != 2 || values["port"] != "8080" || values["db.host"] != "localhost" {
+		t.Errorf("unexpected values: %v", values)
+	}
+
+	// includes can't be resolved without the path of the file
+	if _, err := TextCodec.Decode(bytes.NewBufferString("include=base.conf\n")); err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("expected includes to be rejected, got: %v", err)
+	}
+
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.Int("port", 80, "port")
+	fs.Set("port", "8080")
+	var flags []flag.Flag
+	fs.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, *f)
+	})
+	resWriter := new(bytes.Buffer)
+	if err := TextCodec.Encode(resWriter, flags, map[string]string{"old": "1"}); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	want := `
+# port (int, default 80)
+port=8080
+
+
+# The following options are probably deprecated and not used currently!
+old=1
+`
+	if got := resWriter.String(); got != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+	}
+}
@@ -5,13 +5,24 @@ package confy
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"os/user"
-	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
 	"unicode/utf8"
 )
 
@@ -21,119 +32,2388 @@ const updateWarning = `!!!!!!!!!!
 ! and remove the last "deprecated" paragraph to disable this message!
 !!!!!!!!!!
 `
-const configHeader = `# %s configuration
-# 
-# Empty lines or lines starting with # will be ignored.
-# All other lines must look like "KEY=VALUE" (without the quotes).
-# The VALUE must not be enclosed in quotes as well!
+
+// updateWarningTop is the update warning for DeprecatedTop.
+const updateWarningTop = `!!!!!!!!!!
+! WARNING: .%sinf0 was probably updated,
+! Check and update %s as necessary
+! and remove the first "deprecated" paragraph to disable this message!
+!!!!!!!!!!
+`
+
+// updateWarningFile is the update warning for DeprecatedFile.
+const updateWarningFile = `!!!!!!!!!!
+! WARNING: .%sinf0 was probably updated,
+! Check and update %s as necessary
+! and remove it to disable this message!
+!!!!!!!!!!
 `
+const configHeader = `%[1]s configuration
+
+Empty lines and comments starting with %[2]s will be ignored.
+All other lines must look like "KEY%[3]cVALUE" (without the quotes).
+A boolean KEY without "%[3]cVALUE" is set to true.
+Enclose the VALUE in double or single quotes to keep surrounding spaces.
+Unless single quoted, \n, \r, \t, \\, \%[2]s and \" in the VALUE stand for a
+newline, a carriage return, a tab, a backslash, a %[2]s and a " character.
+$VAR and ${VAR} in the VALUE are replaced by the environment variable VAR,
+use $$ for a literal $. Single quotes prevent this as well.
+A backslash at the end of a line continues the VALUE on the next line.
+KEYs are matched case-insensitively.
+A "[SECTION]" line prefixes all following KEYs with "SECTION.", until the
+next section or an empty "[]" line.
+An "include%[3]cFILE" line applies the config file FILE, relative to this
+one, without overriding the other values of this file.`
+
+// stdinPath is the path for reading the config from os.Stdin, see ParseFile.
+const stdinPath = "-"
+
+// secretPlaceholder is written instead of the values of secret flags, see
+// WithSecret.
+const secretPlaceholder = "****"
+
+// obsoleteBanner introduces the section of obsolete keys in the config file.
+const obsoleteBanner = "The following options are probably deprecated and not used currently!"
+
+// obsoleteMark ends the obsolete keys written commented out, see
+// WithCommentedObsolete.
+const obsoleteMark = "(unknown flag, ignored)"
+
+// obsoleteEnd ends the obsolete keys at the top of the config file, see
+// DeprecatedTop.
+const obsoleteEnd = "End of the deprecated options."
+
+// obsoleteExt is the extension of the file holding the obsolete keys, see
+// DeprecatedFile.
+const obsoleteExt = ".deprecated"
 
-var openOrCreate = os.OpenFile
+// parseMu serializes parsing, as it modifies the flags and the config file.
+var parseMu sync.Mutex
 
+var (
+	openOrCreate = os.OpenFile
+	currentUser  = user.Current
+	goos         = runtime.GOOS
+)
+
+// Parse reads the config file of appName into the flags of flag.CommandLine,
+// writes back an updated config file and then parses the command line.
+//
+// Before parsing the command line, flags are set from environment variables
+// named after the upper case appName and the flag, with dashes, dots and any
+// other characters invalid in the names of shell variables replaced by
+// underscores, e.g. MY_APP_LOG_LEVEL for the app my-app and the flag
+// log-level. So
+// command line arguments take precedence over environment variables, which
+// take precedence over the config file, which takes precedence over the
+// defaults. Values from environment variables are not written to the file.
 func Parse(appName string) error {
-	if flag.Parsed() {
-		return fmt.Errorf("flags have been parsed already")
+	return ParseContext(context.Background(), appName)
+}
+
+// ParseContext is like Parse but gives up reading and writing the config file
+// once ctx is done, e.g. if it is located on an unresponsive network mount,
+// and returns ctx.Err(). A blocked system call cannot be interrupted, ctx is
+// checked before opening, reading and writing the file instead.
+func ParseContext(ctx context.Context, appName string) error {
+	return ParseWith(appName, func(o *options) {
+		o.ctx = ctx
+	})
+}
+
+// ParseSet is like Parse but operates on the given flag set instead of the
+// global flag.CommandLine. The command line arguments are parsed into fs as
+// well, as with fs.Parse(os.Args[1:]).
+func ParseSet(appName string, fs *flag.FlagSet) error {
+	return ParseWith(appName, WithFlagSet(fs))
+}
+
+// ParseFile is like Parse but uses the config file at cPath instead of the
+// default location. appName is still used for the header and warning text.
+// If cPath is "-", the config is read from os.Stdin instead, e.g. when it is
+// generated by another tool. As there is no file to update then, nothing is
+// written back and obsolete keys are not warned about.
+func ParseFile(appName, cPath string) error {
+	return ParseWith(appName, WithPath(cPath))
+}
+
+// ParseFiles is like Parse but applies the config files at paths in order,
+// so later files override the values of earlier ones, e.g. a system wide file
+// followed by a file of the user. Only the last file is written, flags set by
+// earlier files but not by the last one are written to it as commented out
+// suggestions. Keys not matching any flag are collected from all files in the
+// obsolete section of the last file. Missing files other than the last one
+// are skipped.
+func ParseFiles(appName string, paths ...string) error {
+	if len(paths) == 0 {
+		return Parse(appName)
+	}
+	return ParseWith(appName, WithPath(paths[len(paths)-1]), func(o *options) {
+		o.baseFiles = paths[:len(paths)-1]
+	})
+}
+
+// ParseReadOnly is like Parse but never writes the config file, e.g. if it
+// is located on a read-only file system. A missing config file is not an
+// error, the flags simply keep their defaults.
+func ParseReadOnly(appName string) error {
+	return ParseWith(appName, WithReadOnly(true))
+}
+
+// ApplyAndPersist is like ParseWith but seeds the config file with values,
+// e.g. with defaults computed by the application like a machine specific ID.
+// After reading the config file, the flags not set by it are set to values
+// by their names, so they are written to the file and read from it on the
+// next run, while values already in the file are kept. Keys in values not
+// matching any flag are reported as errors before anything is read.
+func ApplyAndPersist(appName string, values map[string]string, opts ...Option) error {
+	return ParseWith(appName, append(opts, func(o *options) {
+		o.seeds = values
+	})...)
+}
+
+// ParseWith is like Parse but its behaviour can be customized with opts.
+func ParseWith(appName string, opts ...Option) error {
+	_, err := ParseDetailed(appName, opts...)
+	return err
+}
+
+// ParseResult describes the outcome of ParseDetailed.
+type ParseResult struct {
+	// Path is the config file used
+	Path string
+	// ObsoleteKeys holds the keys of the config file not matching any flag
+	ObsoleteKeys map[string]string
+	// SetFlags holds the names of the flags set from the config file in
+	// lexicographical order, not counting the defaults and the values of the
+	// environment and the command line
+	SetFlags []string
+	// Changed reports whether the config file was updated, or would have been
+	// updated if it was not read-only
+	Changed bool
+	// IgnoredLines holds the lines of the config file skipped for lacking a
+	// separator or a key by line number, see ErrMalformedLine
+	IgnoredLines map[int]string
+	// Sources holds the origin of the value of each flag, e.g. to show the
+	// effective config, see Source
+	Sources map[string]Source
+	// FirstRun reports whether the config file was missing or empty before,
+	// so it was created with the defaults, unless it is read-only
+	FirstRun bool
+}
+
+// ParseDetailed is like ParseWith but also reports details about the config
+// file, allowing the caller to handle obsolete keys itself, for example.
+//
+// All the Parse functions are safe to call concurrently, they are serialized
+// internally. So only the first call for a flag set succeeds, the others
+// report ErrAlreadyParsed, unless forced by WithForce.
+func ParseDetailed(appName string, opts ...Option) (ParseResult, error) {
+	parseMu.Lock()
+	defer parseMu.Unlock()
+
+	var res ParseResult
+	o := newOptions(appName, opts)
+	if o.fs.Parsed() && (!o.force || o.fs == flag.CommandLine) {
+		return res, ErrAlreadyParsed
+	}
+	if err := o.ctx.Err(); err != nil {
+		return res, err
+	}
+	for _, key := range sortedKeys(o.seeds) {
+		if o.fs.Lookup(key) == nil {
+			return res, fmt.Errorf("unable to persist %s: %w", key, ErrUnknownKey)
+		}
 	}
 
-	cPath, err := getConfigPath(appName)
+	// only the directory of the default location is created
+	createDir := o.path == "" && os.Getenv(o.envVar) == ""
+	cPath, err := o.configPath()
 	if err != nil {
-		return err
+		return res, err
+	}
+	res.Path = cPath
+
+	// apply the base config files, remembering their flags and obsolete keys
+	baseObsolete, err := applyBaseFiles(o)
+	if err != nil {
+		return res, err
+	}
+	o.path = cPath
+
+	// read-only files are never written and a missing file is not created
+	stdin := cPath == stdinPath
+	readOnly := o.readOnly || o.dryRun != nil || stdin
+	if err := o.ctx.Err(); err != nil {
+		return res, err
+	}
+	var cf io.ReadWriteSeeker
+	if readOnly && !stdin {
+		if cf, err = o.openFile(cPath, os.O_RDONLY, 0); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return res, tagError(ErrOpen, fmt.Errorf("unable to open %s config file %v for reading: %w", appName, cPath, err))
+		}
+	} else if !readOnly && !o.create {
+		// a missing file is not created, but an existing one is updated, so
+		// only existing files are locked, which creates the lock file
+		if _, err := os.Stat(cPath); !errors.Is(err, os.ErrNotExist) {
+			unlock, err := o.lockConfig(cPath)
+			if err != nil {
+				return res, err
+			}
+			defer unlock()
+		}
+		if cf, err = o.openFile(cPath, os.O_RDWR, 0); errors.Is(err, os.ErrNotExist) {
+			readOnly = true
+		} else if err != nil {
+			return res, tagError(ErrOpen, fmt.Errorf("unable to open %s config file %v for reading and writing: %w", appName, cPath, err))
+		}
+	} else if !readOnly {
+		if createDir && o.opener == nil {
+			dir := filepath.Dir(cPath)
+			// keep the directory private, see WithFileMode
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return res, tagError(ErrOpen, fmt.Errorf("unable to create config directory %s: %w", dir, err))
+			}
+		}
+		unlock, err := o.lockConfig(cPath)
+		if err != nil {
+			return res, err
+		}
+		defer unlock()
+		if cf, err = o.openFile(cPath, os.O_RDWR|os.O_CREATE, o.fileMode); err != nil {
+			return res, tagError(ErrOpen, fmt.Errorf("unable to open %s config file %v for reading and writing: %w", appName, cPath, err))
+		}
+	}
+	var r io.Reader = strings.NewReader("")
+	perm := o.fileMode
+	if stdin {
+		r = os.Stdin
+	} else if cf != nil {
+		defer func() {
+			closeFile(cf)
+		}()
+		// files of custom openers may not have permissions
+		if st, ok := cf.(interface{ Stat() (os.FileInfo, error) }); ok {
+			fi, err := st.Stat()
+			if err != nil {
+				return res, tagError(ErrOpen, fmt.Errorf("failed to stat %s: %w", cPath, err))
+			}
+			if err := o.checkMode(cPath, fi); err != nil {
+				return res, err
+			}
+			if o.warnMode && fi.Mode().Perm()&^o.fileMode != 0 {
+				o.log.Printf("WARNING: %s has permissions %v, which is more than %v\n", cPath, fi.Mode().Perm(), o.fileMode)
+			}
+			// keep existing permissions, as long as they don't exceed the file mode
+			perm &= fi.Mode().Perm()
+		}
+		r = cf
+	}
+	// compressed files are written compressed again, including their backup
+	r, compressed, err := decompress(r, cPath)
+	if err != nil {
+		return res, fmt.Errorf("failed to parse %s:\n%w", cPath, err)
+	}
+
+	var replace func(name string, content []byte) error
+	if !readOnly {
+		replace = func(name string, content []byte) error {
+			// Windows refuses to rename over files that are still open
+			closeFile(cf)
+			cf = nil
+			if content == nil && o.opener == nil {
+				if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+					return fmt.Errorf("failed to remove %s: %w", name, err)
+				}
+				return nil
+			}
+			if compressed && (name == cPath || name == cPath+".bak") {
+				var err error
+				if content, err = compress(content); err != nil {
+					return fmt.Errorf("failed to compress %s: %w", name, err)
+				}
+			}
+			return o.writeFile(name, content, perm)
+		}
+	}
+	conf, err := updateConfig(o, r, baseObsolete, replace, &res)
+	if err != nil {
+		return res, err
 	}
 
-	cf, err := openOrCreate(cPath, os.O_RDWR|os.O_CREATE, 0666)
+	profileFlags, err := applyProfile(o, conf)
+	if err != nil {
+		return res, err
+	}
+	envFlags, err := applyEnv(o)
 	if err != nil {
-		return fmt.Errorf("unable to open %s config file %v for reading and writing: %v", appName, cPath, err)
+		return res, err
+	}
+	var argFlags []string
+	if !o.noArgs {
+		if err := o.fs.Parse(os.Args[1:]); err != nil {
+			return res, err
+		}
+		argFlags = commandLineFlags(o.fs, os.Args[1:])
+	}
+	res.Sources = flagSources(o, res.SetFlags, profileFlags, envFlags, argFlags)
+	return res, checkFlags(o)
+}
+
+// applyBaseFiles applies the base config files to the flags, see ParseFiles,
+// and marks their flags as inherited. It returns their obsolete keys.
+func applyBaseFiles(o *options) (map[string]string, error) {
+	obsolete := make(map[string]string)
+	for _, path := range o.baseFiles {
+		if err := o.ctx.Err(); err != nil {
+			return nil, err
+		}
+		o.path = path
+		f, err := o.openFile(path, os.O_RDONLY, 0)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, tagError(ErrOpen, fmt.Errorf("unable to open %s config file %v for reading: %w", o.appName, path, err))
+		}
+		if err := o.checkFile(path, f); err != nil {
+			closeFile(f)
+			return nil, err
+		}
+		var conf *config
+		r, _, err := decompress(f, path)
+		if err == nil {
+			conf, err = o.format.parse(o, ctxReader{o.ctx, r})
+		}
+		closeFile(f)
+		if ctxErr := o.ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to parse %s:\n%w", path, err)
+		}
+		for key, val := range conf.obsolete {
+			obsolete[key] = val
+		}
+		for key := range conf.raw {
+			if o.fs.Lookup(key) != nil {
+				if o.inherited == nil {
+					o.inherited = make(map[string]bool)
+				}
+				o.inherited[key] = true
+			}
+		}
+	}
+	return obsolete, nil
+}
+
+// updateConfig applies the config file o.path read from r to the flags and
+// reports the details in res. The updated config is passed to replace, along
+// with the backup of the previous content, but only if it changed. It is
+// called with nil content to remove a file. replace is nil for config files
+// which are never written.
+// baseObsolete holds the obsolete keys of the base files.
+func updateConfig(o *options, r io.Reader, baseObsolete map[string]string, replace func(name string, content []byte) error, res *ParseResult) (*config, error) {
+	// the previous content is only kept if it is needed, otherwise it is
+	// compared by its digest, so large files are not held in memory twice
+	keepOld := o.backup || o.diffSink != nil
+	skip := ""
+	if o.keysOnly {
+		skip = o.commentPrefix
+	}
+	oldConf, oldSum := new(bytes.Buffer), newDigest(skip)
+	var old io.Writer = oldSum
+	if keepOld {
+		old = oldConf
+	}
+	conf, err := o.format.parse(o, io.TeeReader(ctxReader{o.ctx, r}, old))
+	if ctxErr := o.ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to parse %s:\n%w", o.path, err)
+	}
+	for key, val := range baseObsolete {
+		if _, ok := conf.obsolete[key]; !ok && o.fs.Lookup(key) == nil {
+			conf.obsolete[key] = val
+		}
 	}
-	defer cf.Close()
 
-	// read config to buffer and parse
-	oldConf := new(bytes.Buffer)
-	obsoleteKeys := parseConfig(io.TeeReader(cf, oldConf))
-	if len(obsoleteKeys) > 0 {
-		fmt.Fprintf(os.Stderr, updateWarning, appName, cPath)
+	// seeds only set flags missing from the config files, see ApplyAndPersist
+	for _, key := range sortedKeys(o.seeds) {
+		if _, ok := conf.raw[key]; ok || o.inherited[key] {
+			continue
+		}
+		if err := o.fs.Set(key, o.seeds[key]); err != nil {
+			return nil, fmt.Errorf("invalid value %q for flag %s: %w", o.seeds[key], key, err)
+		}
+	}
+
+	// the obsolete keys may be kept in a separate file
+	obsoletePath, msg := o.path, o.updateWarningText
+	var oldObsolete []byte
+	var hasObsolete bool
+	if _, ok := o.format.(textFormat); ok && o.deprecated == DeprecatedFile && o.path != stdinPath {
+		obsoletePath = o.path + obsoleteExt
+		if oldObsolete, hasObsolete, err = readObsolete(o, obsoletePath, conf); err != nil {
+			return nil, err
+		}
+		if msg == updateWarning {
+			msg = updateWarningFile
+		}
+	} else if _, ok := o.format.(textFormat); ok && o.deprecated == DeprecatedTop && msg == updateWarning {
+		msg = updateWarningTop
+	}
+	res.ObsoleteKeys = conf.obsolete
+	res.IgnoredLines = conf.ignored
+	for _, key := range sortedKeys(conf.raw) {
+		if _, ok := conf.obsolete[key]; !ok {
+			res.SetFlags = append(res.SetFlags, key)
+		}
+	}
+	res.FirstRun = oldConf.Len() == 0 && oldSum.n == 0
+	if len(conf.obsolete) > 0 && o.noObsolete {
+		return nil, fmt.Errorf("%w in %s: %s", ErrObsoleteKeys, obsoletePath, strings.Join(sortedKeys(conf.obsolete), ", "))
+	}
+	if len(conf.obsolete) > 0 && o.updateWarning && o.path != stdinPath {
+		if strings.Contains(msg, "%") {
+			msg = fmt.Sprintf(msg, o.appName, obsoletePath)
+		}
+		o.log.Printf("%s", msg)
+		for _, key := range sortedKeys(conf.obsolete) {
+			if text, ok := o.removed[strings.ToLower(key)]; ok {
+				o.log.Printf("WARNING: %s in %s is deprecated: %s\n", key, obsoletePath, text)
+			}
+		}
 	}
 
-	// write updated config to another buffer
+	// write updated config to another buffer, unless it is only compared
 	newConf := new(bytes.Buffer)
-	fmt.Fprintf(newConf, configHeader, appName)
-	saveConfig(newConf, obsoleteKeys)
+	if keepOld || o.dryRun != nil {
+		if err := o.format.save(o, newConf, conf); err != nil {
+			return nil, fmt.Errorf("failed to encode %s: %w", o.path, err)
+		}
+		res.Changed = !bytes.Equal(oldConf.Bytes(), newConf.Bytes())
+		if res.Changed && skip != "" {
+			oldSum.Write(oldConf.Bytes())
+			newSum := newDigest(skip)
+			newSum.Write(newConf.Bytes())
+			res.Changed = !oldSum.equal(newSum)
+		}
+	} else {
+		newSum := newDigest(skip)
+		if err := o.format.save(o, newSum, conf); err != nil {
+			return nil, fmt.Errorf("failed to encode %s: %w", o.path, err)
+		}
+		res.Changed = !oldSum.equal(newSum)
+		if res.Changed && replace != nil {
+			if err := o.format.save(o, newConf, conf); err != nil {
+				return nil, fmt.Errorf("failed to encode %s: %w", o.path, err)
+			}
+		}
+	}
 
 	// only write the file if it changed
-	if !bytes.Equal(oldConf.Bytes(), newConf.Bytes()) {
-		if ofs, err := cf.Seek(0, 0); err != nil || ofs != 0 {
-			return fmt.Errorf("failed to seek to beginning of %s: %v", cPath, err)
-		} else if err = cf.Truncate(0); err != nil {
-			return fmt.Errorf("failed to truncate %s: %v", cPath, err)
-		} else if _, err = newConf.WriteTo(cf); err != nil {
-			return fmt.Errorf("failed to write %s: %v", cPath, err)
+	if err := o.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if o.dryRun != nil {
+		o.dryRun(newConf.Bytes())
+		return conf, nil
+	}
+	if replace != nil && obsoletePath != o.path {
+		// written first, so the obsolete keys are never lost
+		content := new(bytes.Buffer)
+		if len(conf.obsolete) > 0 {
+			writeObsolete(o, content, conf, false)
+		}
+		newObsolete := bytes.TrimLeft(content.Bytes(), "\n")
+		var err error
+		if len(newObsolete) == 0 && hasObsolete {
+			err = replace(obsoletePath, nil)
+		} else if len(newObsolete) > 0 && !bytes.Equal(oldObsolete, newObsolete) {
+			err = replace(obsoletePath, newObsolete)
+		}
+		if err != nil {
+			return nil, tagError(ErrWrite, err)
+		}
+	}
+	if replace != nil && res.Changed {
+		if o.diffSink != nil {
+			o.diffSink(oldConf.Bytes(), newConf.Bytes())
+		}
+		if o.backup && oldConf.Len() > 0 {
+			if err := replace(o.path+".bak", oldConf.Bytes()); err != nil {
+				return nil, tagError(ErrWrite, err)
+			}
+			if err := o.ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		if err := replace(o.path, newConf.Bytes()); err != nil {
+			return nil, tagError(ErrWrite, err)
 		}
 	}
+	return conf, nil
+}
 
-	flag.Parse()
-	return nil
+// digest hashes and counts the bytes written to it. If skip is set, only
+// the lines not starting with skip are hashed without surrounding
+// whitespace, while blank lines are skipped as well.
+type digest struct {
+	h    hash.Hash
+	n    int64
+	skip string
+	line []byte
 }
 
-func getConfigPath(appName string) (string, error) {
-	envname := strings.ToUpper(appName) + "INF0"
-	cPath := os.Getenv(envname)
-	if cPath == "" {
-		usr, err := user.Current()
-		if err != nil {
-			return "", fmt.Errorf("%v\nYou can set the environment variable %s to point to your config file as a workaround", err, envname)
+func newDigest(skip string) *digest {
+	return &digest{h: sha256.New(), skip: skip}
+}
+
+func (d *digest) Write(p []byte) (int, error) {
+	d.n += int64(len(p))
+	if d.skip == "" {
+		return d.h.Write(p)
+	}
+	for rest := p; len(rest) > 0; {
+		i := bytes.IndexByte(rest, '\n')
+		if i == -1 {
+			d.line = append(d.line, rest...)
+			break
 		}
-		cPath = path.Join(usr.HomeDir, "."+strings.ToLower(appName)+"inf0")
+		d.line = append(d.line, rest[:i]...)
+		d.endLine()
+		rest = rest[i+1:]
 	}
-	return cPath, nil
+	return len(p), nil
 }
 
-func parseConfig(r io.Reader) map[string]string {
-	obsKeys := make(map[string]string)
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if strings.HasPrefix(line, "#") || line == "" {
-			continue
+func (d *digest) endLine() {
+	if line := bytes.TrimSpace(d.line); len(line) > 0 && !bytes.HasPrefix(line, []byte(d.skip)) {
+		d.h.Write(append(line, '\n'))
+	}
+	d.line = d.line[:0]
+}
+
+// equal reports whether d and other hashed the same content.
+func (d *digest) equal(other *digest) bool {
+	if d.skip != "" {
+		d.endLine()
+		other.endLine()
+	} else if d.n != other.n {
+		return false
+	}
+	return bytes.Equal(d.h.Sum(nil), other.h.Sum(nil))
+}
+
+// ErrAlreadyParsed is reported if the flags have been parsed before the
+// config file was applied.
+var ErrAlreadyParsed = errors.New("flags have been parsed already")
+
+// ErrOpen is reported if the config file or its directory could not be
+// opened or created.
+var ErrOpen = errors.New("unable to open config file")
+
+// ErrWrite is reported if the updated config file or its backup could not be
+// written.
+var ErrWrite = errors.New("unable to write config file")
+
+// ErrObsoleteKeys is reported for keys not matching any flag, see
+// WithObsoleteAsError.
+var ErrObsoleteKeys = errors.New("obsolete keys")
+
+// ErrInsecurePermissions is reported for config files writable or readable by
+// others, see WithRejectInsecurePermissions and WithRejectReadableByOthers.
+var ErrInsecurePermissions = errors.New("insecure permissions")
+
+// checkMode reports ErrInsecurePermissions if the config file at path with
+// info fi grants access rejected by WithRejectInsecurePermissions or
+// WithRejectReadableByOthers.
+func (o *options) checkMode(path string, fi os.FileInfo) error {
+	if bits := fi.Mode().Perm() & o.insecure; bits != 0 && goos != "windows" {
+		return fmt.Errorf("%w: %s has permissions %v, which grant %s access to others (%v)", ErrInsecurePermissions, path, fi.Mode().Perm(), accessOf(bits), bits)
+	}
+	return nil
+}
+
+// checkFile is like checkMode for the file f opened from path, which is not
+// checked if it doesn't report its info, e.g. for custom openers.
+func (o *options) checkFile(path string, f io.ReadWriteSeeker) error {
+	st, ok := f.(interface{ Stat() (os.FileInfo, error) })
+	if o.insecure == 0 || !ok {
+		return nil
+	}
+	fi, err := st.Stat()
+	if err != nil {
+		return tagError(ErrOpen, fmt.Errorf("failed to stat %s: %w", path, err))
+	}
+	return o.checkMode(path, fi)
+}
+
+// accessOf describes the access granted by the permission bits.
+func accessOf(bits os.FileMode) string {
+	switch {
+	case bits&0022 != 0 && bits&0044 != 0:
+		return "read and write"
+	case bits&0022 != 0:
+		return "write"
+	}
+	return "read"
+}
+
+// taggedError is err marked with the sentinel error kind, so errors.Is
+// matches both, while the message of err is kept.
+type taggedError struct {
+	kind, err error
+}
+
+func tagError(kind, err error) error {
+	return &taggedError{kind, err}
+}
+
+func (e *taggedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *taggedError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+// ErrRequired is reported for required flags which were not set, see
+// WithRequired.
+var ErrRequired = errors.New("missing required flags")
+
+// checkFlags reports all required flags which are still at their default
+// value and all flags rejected by their validators. If all flags are valid,
+// the functions of WithAfterLoad are called.
+func checkFlags(o *options) error {
+	var errs []error
+	var missing []string
+	for _, name := range o.required {
+		if f := o.fs.Lookup(name); f == nil || f.Value.String() == f.DefValue {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		errs = append(errs, fmt.Errorf("%w %s", ErrRequired, strings.Join(missing, ", ")))
+	}
+	for _, v := range o.validators {
+		if f := o.fs.Lookup(v.name); f != nil {
+			if err := v.fn(f.Value.String()); err != nil {
+				errs = append(errs, fmt.Errorf("invalid value %q for flag %s: %w", f.Value.String(), v.name, err))
+			}
 		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	for _, fn := range o.afterLoad {
+		if err := fn(o.fs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		// find first assignment symbol and parse key, val
-		i := strings.IndexAny(line, "=:")
-		if i == -1 {
-			continue
+// WriteDefaultConfig writes a config file for appName with all flags at their
+// default values to w, e.g. to scaffold a new config file. Neither the
+// existing config file nor the current values of the flags are used. The
+// output can be customized with opts like ParseWith.
+func WriteDefaultConfig(appName string, w io.Writer, opts ...Option) error {
+	o := newOptions(appName, opts)
+
+	// copy the flag set with the default values, keeping shorthands sharing
+	// the value of another flag
+	defaults := flag.NewFlagSet(o.fs.Name(), flag.ContinueOnError)
+	values := make(map[sharedKey]flag.Value)
+	o.fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := values[keyOf(f)]; !ok {
+			values[keyOf(f)] = &defaultValue{fixedValue(f.DefValue), f.Value}
 		}
-		key, val := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		defaults.Var(values[keyOf(f)], f.Name, f.Usage)
+	})
+	o.fs = defaults
+	return o.format.save(o, w, nil)
+}
+
+// ConfigPath returns the path of the config file of appName that ParseWith
+// would use with opts, e.g. to tell the user where the settings are stored.
+// Nothing is opened, created or modified, so the file may not exist yet. A
+// path of "-" stands for os.Stdin, see WithPath.
+func ConfigPath(appName string, opts ...Option) (string, error) {
+	return newOptions(appName, opts).configPath()
+}
+
+// defaultValue is the fixed default value of a flag, which keeps the value of
+// the flag to document its type, see usageText.
+type defaultValue struct {
+	fixedValue
+	of flag.Value
+}
+
+// DumpConfig writes the current values of the flags of flag.CommandLine to w
+// in the format of the config file, but without a header or obsolete keys. In
+// contrast to the config file, the values reflect the environment variables
+// and the command line, showing the configuration actually in effect. The
+// values of secret flags are masked, see WithSecret.
+func DumpConfig(w io.Writer, opts ...Option) error {
+	cw := &errWriter{w: w}
+	saveConfig(newOptions("", opts), cw, nil)
+	return cw.err
+}
+
+// errWriter remembers the first error writing to w.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (c *errWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.err = err
+	return n, err
+}
 
-		if err := flag.Set(key, val); err != nil {
-			obsKeys[key] = val
+// applyProfile applies the profile of conf selected by WithProfile to the
+// flags, overriding the values of the other keys of the config file, and
+// returns the keys of the profile.
+func applyProfile(o *options, conf *config) ([]string, error) {
+	if o.profile == "" {
+		return nil, nil
+	}
+	for _, p := range conf.profiles {
+		if !strings.EqualFold(p.name, o.profile) {
 			continue
 		}
+		// keep the line numbers of the config file for errors
+		body := strings.Repeat("\n", p.line) + strings.Join(p.lines[p.header+1:], "\n")
+		pconf, err := parseConfigFile(o, strings.NewReader(body), rootIncludes(o), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply profile %s of %s:\n%w", p.name, o.path, err)
+		}
+		return sortedKeys(pconf.raw), nil
+	}
+	o.log.Printf("WARNING: profile %s not found in %s\n", o.profile, o.path)
+	return nil, nil
+}
+
+// ctxReader is an io.Reader failing with ctx.Err() once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
 	}
-	return obsKeys
+	return r.r.Read(p)
 }
 
-func saveConfig(w io.Writer, obsKeys map[string]string) {
-	// find flags pointing to the same variable. We will only write the longest
-	// named flag to the config file, the shorthand version is ignored.
-	deduped := make(map[flag.Value]flag.Flag)
-	flag.VisitAll(func(f *flag.Flag) {
-		if cur, ok := deduped[f.Value]; !ok || utf8.RuneCountInString(f.Name) > utf8.RuneCountInString(cur.Name) {
-			deduped[f.Value] = *f
+// applyEnv sets the flags from their environment variables, if set, and
+// returns the names of the flags set. The environment values are applied
+// after the config file was written, so they are never persisted.
+func applyEnv(o *options) ([]string, error) {
+	if o.envPrefix == "" {
+		return nil, nil
+	}
+	var names []string
+	var err error
+	o.fs.VisitAll(func(f *flag.Flag) {
+		name := envName(o.envPrefix, f.Name)
+		if val, ok := os.LookupEnv(name); ok && err == nil {
+			if setErr := o.fs.Set(f.Name, val); setErr != nil {
+				err = fmt.Errorf("invalid value %q for flag %s from environment variable %s: %w", val, f.Name, name, setErr)
+			}
+			names = append(names, f.Name)
 		}
 	})
-	flag.VisitAll(func(f *flag.Flag) {
-		if cur, ok := deduped[f.Value]; ok && cur.Name == f.Name {
-			_, usage := flag.UnquoteUsage(f)
-			usage = strings.Replace(usage, "\n    \t", "\n# ", -1)
-			fmt.Fprintf(w, "\n# %s (default %v)\n", usage, f.DefValue)
-			fmt.Fprintf(w, "%s=%v\n", f.Name, f.Value.String())
+	return names, err
+}
+
+// envName returns the environment variable for the flag name, i.e. name with
+// dashes and dots replaced by underscores, upper cased and prefixed.
+func envName(prefix, name string) string {
+	return prefix + envKey(name)
+}
+
+// envKey returns name in upper case with all characters but letters, digits
+// and underscores replaced by underscores, so it can be set by POSIX shells.
+func envKey(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		} else if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
 		}
-	})
+		return '_'
+	}, name)
+}
 
-	// if we have obsolete keys left from the old config, preserve them in an
-	// additional section at the end of the file
-	if obsKeys != nil && len(obsKeys) > 0 {
-		fmt.Fprintln(w, "\n\n# The following options are probably deprecated and not used currently!")
-		for key, val := range obsKeys {
-			fmt.Fprintf(w, "%v=%v\n", key, val)
+// openFile opens the file at path like os.OpenFile, using the opener of o if
+// set, see WithOpener.
+func (o *options) openFile(path string, flag int, perm os.FileMode) (io.ReadWriteSeeker, error) {
+	if o.opener != nil {
+		return o.opener(path, flag, perm)
+	}
+	f, err := openOrCreate(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// closeFile closes f if it can be closed.
+func closeFile(f io.ReadWriteSeeker) {
+	if c, ok := f.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// writeFile replaces the content of the file name. Files on disk are
+// replaced atomically by replaceFile, while files of a custom opener are
+// opened with os.O_TRUNC and written.
+func (o *options) writeFile(name string, content []byte, perm os.FileMode) error {
+	if o.opener == nil {
+		return replaceFile(name, content, perm)
+	}
+	f, err := o.opener(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("unable to open %s for writing: %w", name, err)
+	}
+	defer closeFile(f)
+	if _, err := f.Write(content); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+// replaceFile atomically replaces the content of the file name by writing a
+// temporary file in the same directory and renaming it over name. Symbolic
+// links are followed, so the link itself is preserved.
+func replaceFile(name string, content []byte, perm os.FileMode) error {
+	if target, err := filepath.EvalSymlinks(name); err == nil {
+		name = target
+	}
+	dir := filepath.Dir(name)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to rewrite %s, failed to create a temporary file in %s: %w", name, dir, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", tmp.Name(), err)
+	} else if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set permissions of %s: %w", tmp.Name(), err)
+	} else if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync %s: %w", tmp.Name(), err)
+	} else if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", name, err)
+	}
+	return nil
+}
+
+// commentLines turns every line of text into a comment starting with prefix.
+// Like when reading the file, a lone \r ends a line as well.
+func commentLines(prefix, text string) string {
+	lines := strings.Split(strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(text), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(prefix+" "+line, " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// DefaultPathFunc, if set, returns the default path of the config file of
+// appName instead of the user's config directory, e.g. for packagers setting
+// it in an init function to use /etc/appname/config. The environment variable
+// pointing to the config file still takes precedence, while an empty path
+// falls back to the usual location. Like the usual location, the directory of
+// the path is created together with the config file.
+var DefaultPathFunc func(appName string) (string, error)
+
+// homeDir returns the home directory of the current user. If the user
+// database is not available, e.g. for static binaries in minimal containers,
+// it falls back to $HOME or its equivalent on the platform.
+func homeDir() (string, error) {
+	usr, err := currentUser()
+	if err == nil && usr.HomeDir != "" {
+		return usr.HomeDir, nil
+	}
+	home, homeErr := os.UserHomeDir()
+	if homeErr != nil {
+		if err != nil {
+			return "", err
+		}
+		return "", homeErr
+	}
+	return home, nil
+}
+
+// ErrInvalidAppName is reported for an appName which is empty, contains path
+// separators or white space, or is "." or "..", so it can't be used as file
+// name. The file and directory names use the lower case appName, the
+// environment variables the upper case one, so appName is case-insensitive.
+var ErrInvalidAppName = errors.New("invalid app name")
+
+// checkAppName reports whether appName is usable in the config path and the
+// names of the environment variables.
+func checkAppName(appName string) error {
+	if appName == "" || appName == "." || appName == ".." {
+		return fmt.Errorf("%w %q", ErrInvalidAppName, appName)
+	}
+	if i := strings.IndexFunc(appName, func(r rune) bool {
+		return r == '/' || r == '\\' || unicode.IsSpace(r) || unicode.IsControl(r)
+	}); i != -1 {
+		r, _ := utf8.DecodeRuneInString(appName[i:])
+		return fmt.Errorf("%w %q: %q is not allowed", ErrInvalidAppName, appName, r)
+	}
+	return nil
+}
+
+// getConfigPath returns the path of the config file for appName. The
+// environment variable envname takes precedence, followed by DefaultPathFunc
+// and an already existing legacy ~/.appnameinf0 file for the .ini extension.
+// Otherwise the file config.EXT is located in the user's config directory,
+// which is only created together with the config file.
+func getConfigPath(appName, envname, ext string) (string, error) {
+	if cPath := os.Getenv(envname); cPath != "" {
+		return cPath, nil
+	}
+	if DefaultPathFunc != nil {
+		if cPath, err := DefaultPathFunc(appName); err != nil || cPath != "" {
+			return cPath, err
+		}
+	}
+
+	home, err := homeDir()
+	if err != nil {
+		return "", fmt.Errorf("%w\nYou can set the environment variable %s to point to your config file as a workaround", err, envname)
+	}
+	legacyPath := filepath.Join(home, "."+strings.ToLower(appName)+"inf0")
+	if _, err := os.Stat(legacyPath); err == nil && ext == ".ini" {
+		return legacyPath, nil
+	}
+
+	dir, err := configDir(home)
+	if err != nil {
+		return "", fmt.Errorf("%w\nYou can set the environment variable %s to point to your config file as a workaround", err, envname)
+	}
+	return filepath.Join(dir, strings.ToLower(appName), "config"+ext), nil
+}
+
+// configDir returns the base directory for config files. On Linux the XDG
+// Base Directory spec is followed, on Windows %APPDATA% is used and other
+// platforms use os.UserConfigDir.
+func configDir(home string) (string, error) {
+	switch goos {
+	case "linux":
+		if dir := os.Getenv("XDG_CONFIG_HOME"); filepath.IsAbs(dir) {
+			return dir, nil
+		}
+		return filepath.Join(home, ".config"), nil
+	case "windows":
+		if dir := os.Getenv("APPDATA"); dir != "" {
+			return dir, nil
+		}
+		return "", fmt.Errorf("%%APPDATA%% is not defined")
+	}
+	return os.UserConfigDir()
+}
+
+// config holds the state read from a config file by parseConfig.
+type config struct {
+	// obsolete holds the values of keys not matching any flag
+	obsolete map[string]string
+	// raw holds the flag and obsolete values as written in the config file
+	raw map[string]rawValue
+	// comments holds the comments added by the user to the flag and obsolete
+	// keys
+	comments map[string]keyComments
+	// trailing holds the comment lines after the last key
+	trailing []string
+	// includes holds the include lines, which are preserved as they are
+	includes []include
+	// order holds the flags in the order they first appeared in the config
+	// file, including commented out suggestions
+	order []string
+	// version is the version of the config file and versionComments are the
+	// comments of its line, see WithMigration
+	version         int
+	versionComments keyComments
+	// profiles holds the profiles, which are preserved as they are
+	profiles []profile
+	// ignored holds the lines without separator or key by line number,
+	// which are dropped
+	ignored map[int]string
+}
+
+// profilePrefix starts the sections holding profiles, see WithProfile.
+const profilePrefix = "profile:"
+
+// profile is a section of the config file only applied if selected.
+type profile struct {
+	name string
+	// line is the line number of the section header
+	line int
+	// header is the index of the section header in lines
+	header int
+	// lines are the lines of the profile as written, including the preceding
+	// comments and the section header
+	lines []string
+}
+
+// appeared records that the flag name appeared in the config file.
+func (c *config) appeared(name string) {
+	for _, n := range c.order {
+		if n == name {
+			return
+		}
+	}
+	c.order = append(c.order, name)
+}
+
+// include is a line of the config file including another file. pos is the
+// number of flags appearing before it, see config.order, so it is written back
+// at its position.
+type include struct {
+	text     string
+	comments keyComments
+	pos      int
+}
+
+// keyComments are the comments of a key in the config file which were not
+// generated by saveConfig.
+type keyComments struct {
+	// before holds the comment lines preceding the key, with empty strings
+	// for empty lines between them
+	before []string
+	// inline is the comment following the value on the same line
+	inline string
+}
+
+// rawValue is the text of a value in the config file together with the
+// resulting value of the flag or obsolete key.
+type rawValue struct {
+	text  string
+	value string
+}
+
+// text returns the text to write for the value val of key. This is the text
+// read from the config file if the value did not change since.
+func (c *config) text(o *options, key, val string) string {
+	if raw, ok := c.raw[key]; ok && raw.value == val {
+		return raw.text
+	}
+	return o.formatValue(val)
+}
+
+// formatValue is formatValue with the comment prefix of o. Values equal to the
+// unset marker are quoted, so they aren't read as the marker, see
+// WithUnsetMarker.
+func (o *options) formatValue(val string) string {
+	text := formatValue(val, o.commentPrefix)
+	if o.unset != "" && text == o.unset {
+		return `"` + text + `"`
+	}
+	return text
+}
+
+// line returns the line to write for the value val of the flag or obsolete
+// key name, written as key within its section, including its inline comment.
+func (c *config) line(o *options, key, name, val string) string {
+	return key + string(o.writeSeparator()) + c.text(o, name, val) + inlineComment(c.comments[name])
+}
+
+// secretText returns the text to write for the secret flag f instead of its
+// value. This is the text read from the config file, or the placeholder if the
+// flag is missing from the file and not empty.
+func (c *config) secretText(f *flag.Flag) string {
+	if raw, ok := c.raw[f.Name]; ok {
+		return raw.text
+	} else if f.Value.String() == "" {
+		return ""
+	}
+	return secretPlaceholder
+}
+
+// listText returns the text to write for the list flag f, see WithList. This
+// is the text read from the config file if the value did not change since.
+// Otherwise, if f.Value is a flag.Getter returning a []string, the elements
+// are joined with sep, quoting elements containing sep. Any other value is
+// expected to be joined with sep already by its String method.
+func (c *config) listText(f *flag.Flag, sep, prefix string) string {
+	val := f.Value.String()
+	if raw, ok := c.raw[f.Name]; ok && raw.value == val {
+		return raw.text
+	}
+	g, ok := f.Value.(flag.Getter)
+	if !ok {
+		return formatValue(val, prefix)
+	}
+	elems, ok := g.Get().([]string)
+	if !ok {
+		return formatValue(val, prefix)
+	}
+	texts := make([]string, len(elems))
+	for i, elem := range elems {
+		texts[i] = formatValue(elem, prefix)
+		if elem == "" || strings.Contains(texts[i], sep) && !strings.HasPrefix(texts[i], `"`) {
+			texts[i] = `"` + strings.Replace(texts[i], `"`, `\"`, -1) + `"`
+		}
+	}
+	return strings.Join(texts, sep)
+}
+
+// inlineComment returns the inline comment of c to append to its line.
+func inlineComment(c keyComments) string {
+	if c.inline == "" {
+		return ""
+	}
+	return " " + c.inline
+}
+
+// ErrUnknownKey is reported in strict mode for keys not matching any flag.
+var ErrUnknownKey = errors.New("unknown key")
+
+// ErrDuplicateKey is reported in strict mode for keys set more than once.
+var ErrDuplicateKey = errors.New("duplicate key")
+
+// ErrMalformedLine is reported in strict mode for lines without separator,
+// unless they set a boolean flag, and for lines without key.
+var ErrMalformedLine = errors.New("malformed line")
+
+// errMissingKey is the ErrMalformedLine of lines without key, e.g. "=5".
+var errMissingKey = fmt.Errorf("%w without key", ErrMalformedLine)
+
+// LineError describes a line of the config file with a value that could not
+// be applied to its flag, or with an unknown or duplicate key or a malformed
+// line in strict mode. Value holds the malformed line.
+type LineError struct {
+	Line  int
+	Key   string
+	Value string
+	Err   error
+}
+
+func (e *LineError) Error() string {
+	if e.Err == ErrUnknownKey {
+		return fmt.Sprintf("line %d: unknown key %s", e.Line, e.Key)
+	} else if errors.Is(e.Err, ErrDuplicateKey) {
+		return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+	} else if e.Err == ErrMalformedLine {
+		return fmt.Sprintf("line %d: %v %q without separator", e.Line, e.Err, e.Value)
+	} else if e.Err == errMissingKey {
+		return fmt.Sprintf("line %d: %v %q without key", e.Line, ErrMalformedLine, e.Value)
+	}
+	return fmt.Sprintf("line %d: invalid value %q for flag %s: %v", e.Line, e.Value, e.Key, e.Err)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// includeKey is the key of lines including another config file.
+const includeKey = "include"
+
+// maxIncludeDepth limits the nesting of included config files.
+const maxIncludeDepth = 10
+
+// includes tracks the config files being parsed to resolve and guard the
+// files they include.
+type includes struct {
+	// dir is the directory relative paths are resolved against
+	dir string
+	// visiting holds the absolute paths of the files being parsed
+	visiting map[string]bool
+	depth    int
+	// disabled rejects all includes, see TextCodec
+	disabled bool
+}
+
+// parseConfig applies the config file read from r to the flags. Keys not
+// matching any flag are collected as obsolete, or reported as errors in strict
+// mode, while lines that cannot be applied to an existing flag are reported as
+// errors. Obsolete keys of a previous run are applied to flags added for them
+// again, but they stay obsolete with a warning if their values are invalid for
+// the new flags, unless in strict mode. Values are parsed by the flags like on
+// the command line, e.g. integers with a leading 0 are octal numbers, so 08080
+// is invalid.
+//
+// Leading and trailing whitespace as defined by unicode.IsSpace, e.g. tabs, is
+// trimmed from every line, including continuation lines, so lines may be
+// indented. Keys and values are trimmed around the separator as well, except
+// for quoted values. Whitespace within a key is kept as part of the key.
+//
+// Lines with the key include, unless there is a flag of that name, apply the
+// config file at their value before continuing. Relative paths are resolved
+// against the directory of the including file, which is o.path. The values
+// of the including file take precedence, regardless of their position.
+func parseConfig(o *options, r io.Reader) (*config, error) {
+	return parseConfigFile(o, r, rootIncludes(o), nil)
+}
+
+// rootIncludes returns the includes of the config file at o.path itself.
+func rootIncludes(o *options) *includes {
+	inc := &includes{dir: filepath.Dir(o.path), visiting: make(map[string]bool)}
+	if abs, err := filepath.Abs(o.path); err == nil && o.path != "" {
+		inc.visiting[abs] = true
+	}
+	return inc
+}
+
+// parseConfigFile implements parseConfig for a possibly included file. Keys in
+// skip were set by including files already and are ignored.
+func parseConfigFile(o *options, r io.Reader, inc *includes, skip map[string]bool) (*config, error) {
+	conf := &config{
+		obsolete: make(map[string]string),
+		raw:      make(map[string]rawValue),
+		comments: make(map[string]keyComments),
+	}
+	// flag names by their lower case version to resolve keys case-insensitively
+	names := make(map[string]string)
+	o.fs.VisitAll(func(f *flag.Flag) {
+		names[strings.ToLower(f.Name)] = f.Name
+	})
+
+	// comment and empty lines since the last key, the first paragraph of
+	// comments followed by an empty line is the generated header and the
+	// banner and the end of the obsolete keys are generated as well
+	var comments []string
+	header, banner, end := true, o.commentPrefix+" "+obsoleteBanner, o.commentPrefix+" "+obsoleteEnd
+
+	// the first paragraph of comments directly preceding a key was written by
+	// the user, unless it is the generated header
+	var headerLines []string
+	keepHeader := func() {
+		if header && len(headerLines) > 0 && strings.Join(headerLines, "\n") != o.headerComment() {
+			comments = append(headerLines, comments...)
+		}
+	}
+
+	// the profile whose lines are currently read, see WithProfile
+	var prof *profile
+	// whether the obsolete keys following the banner are read
+	var inObsolete bool
+
+	// line numbers of the keys seen so far to detect duplicates, and their
+	// spelling and value to detect conflicting aliases
+	seen := make(map[string]int)
+	type assignment struct{ spelling, value string }
+	assigned := make(map[string]assignment)
+
+	var errs []error
+
+	// malformed reports the line starting at start, or records it as ignored
+	malformed := func(start int, line string, err error) {
+		if o.strict {
+			errs = append(errs, &LineError{start, "", line, err})
+			return
+		}
+		if conf.ignored == nil {
+			conf.ignored = make(map[int]string)
+		}
+		conf.ignored[start] = line
+	}
+
+	section, lineNum := "", 0
+	scanner := newLineScanner(r, o.maxLine)
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if lineNum == 1 {
+			// some editors start the file with a byte order mark
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		raw := line
+		line = strings.TrimSpace(line)
+		isSection := strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]")
+
+		// profiles are kept verbatim up to the next section or the banner of
+		// the obsolete keys
+		if prof != nil && !isSection && line != banner {
+			prof.lines = append(prof.lines, raw)
+			continue
+		}
+		prof = nil
+		if isSection && strings.HasPrefix(strings.TrimSpace(line[1:len(line)-1]), profilePrefix) {
+			name := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line[1:len(line)-1]), profilePrefix))
+			keepHeader()
+			before := userComments(comments, nil, "", o.commentPrefix)
+			conf.profiles = append(conf.profiles, profile{name, lineNum, len(before), append(before, raw)})
+			prof = &conf.profiles[len(conf.profiles)-1]
+			comments, header = nil, false
+			continue
+		}
+
+		// ; starts comment lines as well, as in INI files
+		// obsolete keys may be commented out, see WithCommentedObsolete
+		if inObsolete && strings.HasPrefix(line, o.commentPrefix) && strings.HasSuffix(line, obsoleteMark) {
+			line = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, o.commentPrefix), obsoleteMark))
+		}
+		if strings.HasPrefix(line, o.commentPrefix) || strings.HasPrefix(line, ";") || line == "" {
+			header = header && line != ""
+			inObsolete = inObsolete && line != end || line == banner
+			if line == banner || line == end || o.isCategoryHeader(line) {
+				continue
+			} else if header {
+				headerLines = append(headerLines, line)
+				continue
+			}
+			// flags omitted with their default value are regenerated, but the
+			// comments of the user preceding them are kept
+			if f := suggestion(o, names, section, line, comments); f != nil {
+				conf.comments[f.Name] = keyComments{before: flagComments(o, f, comments)}
+				conf.appeared(f.Name)
+				comments = nil
+				continue
+			}
+			comments = append(comments, line)
+			continue
+		}
+		keepHeader()
+		header = false
+
+		// section headers prefix the following keys, [] resets to top level
+		if isSection {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		// join lines ending with an unescaped backslash with the next one
+		start := lineNum
+		for continues(line) {
+			line = line[:len(line)-1]
+			if !scanner.Scan() {
+				break
+			}
+			lineNum++
+			line += strings.TrimSpace(scanner.Text())
+		}
+
+		// find the assignment symbol and parse key, val. = takes precedence
+		// over :, so values may contain colons, e.g. in URLs
+		i := indexSeparator(line, o)
+		if i == -1 {
+			// a boolean flag without value is set to true, like on the command
+			// line, other lines without separator are ignored
+			n := commentIndex(line, o.commentPrefix)
+			if f := o.fs.Lookup(resolveKey(o, names, section, line[:n])); f == nil || !isBoolFlag(f) {
+				malformed(start, line, ErrMalformedLine)
+				continue
+			}
+			line = strings.TrimSpace(line[:n]) + string(o.writeSeparator()) + "true " + line[n:]
+			i = indexSeparator(line, o)
+		} else if strings.TrimSpace(line[:i]) == "" {
+			malformed(start, line, errMissingKey)
+			continue
+		}
+		// the text keeps the whitespace after the separator, which may start a
+		// trailing comment, see commentIndex
+		key, text := resolveKey(o, names, section, line[:i]), line[i+1:]
+		spelling := strings.TrimSpace(line[:i])
+		if section != "" {
+			spelling = section + "." + spelling
+		}
+		before := comments
+		comments = nil
+		isInclude := section == "" && strings.EqualFold(key, includeKey) && o.fs.Lookup(key) == nil
+		isVersion := section == "" && len(o.migrations) > 0 && strings.EqualFold(key, versionKey) && o.fs.Lookup(key) == nil
+		first, dup := seen[key]
+		// different aliases of a flag are only reported if their values differ,
+		// spellings differing in case, dashes and underscores are the same key
+		aliasDup := dup && keySpelling(assigned[key].spelling) != keySpelling(spelling)
+		if skip[key] && !isInclude {
+			continue
+		} else if dup && o.strict && !isInclude {
+			errs = append(errs, &LineError{start, key, "", fmt.Errorf("%w %s, first set in line %d", ErrDuplicateKey, key, first)})
+			continue
+		} else if dup && !aliasDup && !isInclude && !inObsolete {
+			o.log.Printf("WARNING: duplicate key %s in line %d overrides line %d\n", key, start, first)
+		}
+		var val string
+		var elems []string
+		var n int
+		var err error
+		sep, isList := o.lists[key]
+		if isList {
+			elems, n, err = parseList(o, text, sep)
+			val = strings.Join(elems, sep)
+		} else if val, n, err = parseValue(text, o.commentPrefix); err == nil && !strings.HasPrefix(strings.TrimSpace(text), "'") {
+			val, err = expandEnv(val, o.strictEnv)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: invalid value for %s: %w", start, key, err))
+			continue
+		}
+		text, inline := strings.TrimSpace(text[:n]), strings.TrimSpace(text[n:])
+		if prev := assigned[key]; aliasDup && !isInclude && prev.value != val {
+			o.log.Printf("WARNING: %s in line %d overrides %s in line %d, %s is set to %q instead of %q\n",
+				spelling, start, prev.spelling, first, key, val, prev.value)
+		}
+		seen[key] = start
+		assigned[key] = assignment{spelling, val}
+
+		if isVersion {
+			if conf.version, err = strconv.Atoi(val); err != nil {
+				errs = append(errs, fmt.Errorf("line %d: invalid value for %s: %w", start, key, err))
+			}
+			conf.versionComments = keyComments{userComments(before, nil, "", o.commentPrefix), inline}
+			continue
+		}
+		if isInclude {
+			conf.includes = append(conf.includes, include{text, keyComments{userComments(before, nil, "", o.commentPrefix), inline}, len(conf.order)})
+			// keys set so far and by including files take precedence
+			parentKeys := make(map[string]bool)
+			for key := range skip {
+				parentKeys[key] = true
+			}
+			for key := range seen {
+				parentKeys[key] = true
+			}
+			if err := includeFile(o, inc, val, parentKeys); err != nil {
+				errs = append(errs, fmt.Errorf("line %d: %w", start, err))
+			}
+			continue
+		}
+
+		f := o.fs.Lookup(key)
+		if f == nil && o.strict {
+			errs = append(errs, &LineError{start, key, val, ErrUnknownKey})
+			continue
+		} else if f == nil {
+			conf.obsolete[key] = val
+			conf.raw[key] = rawValue{text, val}
+			conf.comments[key] = keyComments{userComments(before, o.deprecationComment(key), "", o.commentPrefix), inline}
+			continue
+		}
+		// the elements of lists are set one by one like repeated flags on the
+		// command line
+		if !isList {
+			elems = []string{val}
+			if o.unset != "" && text == o.unset {
+				elems = []string{f.DefValue}
+			}
+		}
+		// flags added again for obsolete keys take over their values, unless
+		// they are invalid for the new flag
+		failed, prev := false, f.Value.String()
+		for _, elem := range elems {
+			if err := o.fs.Set(key, normalizeValue(f, elem)); err != nil && inObsolete && !isList && !o.strict {
+				// some flags are changed by invalid values, e.g. to zero
+				f.Value.Set(prev)
+				o.log.Printf("WARNING: keeping obsolete key %s in line %d, its value %q is invalid for the flag: %v\n", key, start, val, err)
+				conf.obsolete[key] = val
+				conf.raw[key] = rawValue{text, val}
+				conf.comments[key] = keyComments{userComments(before, o.deprecationComment(key), "", o.commentPrefix), inline}
+				failed = true
+			} else if err != nil {
+				errs = append(errs, &LineError{start, key, elem, err})
+				failed = true
+			}
+		}
+		if failed {
+			continue
+		}
+		conf.raw[key] = rawValue{text, valueString(f)}
+		conf.appeared(key)
+		conf.comments[key] = keyComments{flagComments(o, f, before), inline}
+	}
+	if err := scanner.Err(); err != nil {
+		return conf, scanError(err, lineNum, o.maxLine)
+	}
+	conf.trailing = userComments(comments, nil, "", o.commentPrefix)
+	if n := len(conf.trailing); n > 0 && conf.trailing[n-1] == "" {
+		conf.trailing = conf.trailing[:n-1]
+	}
+	return conf, errors.Join(errs...)
+}
+
+// parseList interprets the raw value of a config line for a list flag, see
+// WithList. The value is split at each sep outside of quotes and the elements
+// are interpreted like single values by parseValue and expandEnv. Empty
+// elements are skipped unless they are quoted. Besides the elements, the
+// length of the value's text is returned like by parseValue.
+func parseList(o *options, text, sep string) ([]string, int, error) {
+	var elems []string
+	pieces, n := splitList(text, sep, o.commentPrefix)
+	for _, piece := range pieces {
+		if piece = strings.TrimSpace(piece); piece == "" {
+			continue
+		}
+		elem, _, err := parseValue(piece, o.commentPrefix)
+		if err == nil && !strings.HasPrefix(piece, "'") {
+			elem, err = expandEnv(elem, o.strictEnv)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		elems = append(elems, elem)
+	}
+	return elems, n, nil
+}
+
+// splitList splits text at each sep which is neither quoted nor escaped, up to
+// the first unquoted comment prefix, and returns the pieces and the index
+// where the comment starts, or len(text) if there is none. Quotes only count
+// at the start of a piece.
+func splitList(text, sep, prefix string) ([]string, int) {
+	var pieces []string
+	start, quote := 0, byte(0)
+	for i := 0; i < len(text); i++ {
+		switch {
+		case quote != 0:
+			if text[i] == '\\' && quote == '"' {
+				i++
+			} else if text[i] == quote {
+				quote = 0
+			}
+		case text[i] == '\\':
+			i++
+		case (text[i] == '"' || text[i] == '\'') && strings.TrimSpace(text[start:i]) == "":
+			quote = text[i]
+		case startsComment(text, i, prefix):
+			return append(pieces, text[start:i]), i
+		case strings.HasPrefix(text[i:], sep):
+			pieces = append(pieces, text[start:i])
+			start = i + len(sep)
+			i = start - 1
+		}
+	}
+	return append(pieces, text[start:]), len(text)
+}
+
+// includeFile applies the config file at path included by a file parsed with
+// inc. The flags set by the included file are marked as inherited, so they are
+// not written to the including file, while its obsolete keys are discarded.
+func includeFile(o *options, inc *includes, path string, skip map[string]bool) error {
+	if inc.disabled {
+		return fmt.Errorf("unable to include %s, includes are not supported by TextCodec.Decode", path)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(inc.dir, path)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("unable to include %s: %w", path, err)
+	} else if inc.visiting[abs] {
+		return fmt.Errorf("unable to include %s, it includes itself", path)
+	} else if inc.depth >= maxIncludeDepth {
+		return fmt.Errorf("unable to include %s, includes are nested more than %d levels deep", path, maxIncludeDepth)
+	}
+	f, err := o.openFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("unable to include %s: %w", path, err)
+	}
+	defer closeFile(f)
+	if err := o.checkFile(path, f); err != nil {
+		return err
+	}
+
+	inc.visiting[abs] = true
+	defer delete(inc.visiting, abs)
+	conf, err := parseConfigFile(o, ctxReader{o.ctx, f}, &includes{dir: filepath.Dir(path), visiting: inc.visiting, depth: inc.depth + 1}, skip)
+	if err != nil {
+		return fmt.Errorf("failed to parse included %s:\n%w", path, err)
+	}
+	for key := range conf.raw {
+		if o.fs.Lookup(key) != nil {
+			if o.inherited == nil {
+				o.inherited = make(map[string]bool)
+			}
+			o.inherited[key] = true
+		}
+	}
+	return nil
+}
+
+// resolveKey returns the name of the flag for key in section, matching the
+// flag names case-insensitively, or the full key if there is no such flag.
+// Old names of renamed flags resolve to the new flag, see WithAlias.
+func resolveKey(o *options, names map[string]string, section, key string) string {
+	key = strings.TrimSpace(key)
+	if section != "" {
+		key = section + "." + key
+	}
+	if name, ok := names[strings.ToLower(key)]; ok && o.fs.Lookup(key) == nil {
+		key = name
+	} else if name, ok := o.aliases[strings.ToLower(key)]; ok && o.fs.Lookup(key) == nil && o.fs.Lookup(name) != nil {
+		key = name
+	} else if o.fs.Lookup(key) == nil {
+		// dashes and underscores are interchangeable, see WithKeyStyle
+		lower := strings.ToLower(key)
+		for _, alt := range []string{strings.ReplaceAll(lower, "_", "-"), strings.ReplaceAll(lower, "-", "_")} {
+			if name, ok := names[alt]; ok {
+				return name
+			}
+		}
+	}
+	return key
+}
+
+// keySpelling returns key in lower case with underscores replaced by dashes,
+// which are interchangeable, see WithKeyStyle.
+func keySpelling(key string) string {
+	return strings.ReplaceAll(strings.ToLower(key), "_", "-")
+}
+
+// suggestion checks whether the comment line is a flag commented out by
+// saveConfig, see WithOmitDefaults, i.e. whether it directly follows the usage
+// comment of the flag. If so, the flag is returned.
+func suggestion(o *options, names map[string]string, section, line string, comments []string) *flag.Flag {
+	line = strings.TrimSpace(strings.TrimPrefix(line, o.commentPrefix))
+	i := indexSeparator(line, o)
+	if i == -1 {
+		return nil
+	}
+	f := o.fs.Lookup(resolveKey(o, names, section, line[:i]))
+	if f == nil {
+		return nil
+	}
+	usage := strings.Split(usageComment(o, f), "\n")
+	if n := len(comments) - len(usage); n < 0 || !equalLines(comments[n:], usage) {
+		return nil
+	}
+	return f
+}
+
+// applyValues applies values read by a format without line information to the
+// flags, matching keys case-insensitively like parseConfig. Keys not matching
+// any flag are collected as obsolete, or reported as errors in strict mode.
+func applyValues(o *options, values map[string]string) (*config, error) {
+	conf := &config{
+		obsolete: make(map[string]string),
+		raw:      make(map[string]rawValue),
+		comments: make(map[string]keyComments),
+	}
+	names := make(map[string]string)
+	o.fs.VisitAll(func(f *flag.Flag) {
+		names[strings.ToLower(f.Name)] = f.Name
+	})
+
+	var errs []error
+	for _, key := range sortedKeys(values) {
+		val := values[key]
+		if strings.TrimSpace(key) == "" {
+			if o.strict {
+				errs = append(errs, fmt.Errorf("%w: value %q without key", ErrMalformedLine, val))
+			} else {
+				o.log.Printf("WARNING: ignoring value %q without key\n", val)
+			}
+			continue
+		}
+		name := resolveKey(o, names, "", key)
+		f := o.fs.Lookup(name)
+		if f == nil && o.strict {
+			errs = append(errs, fmt.Errorf("%w %s", ErrUnknownKey, key))
+			continue
+		} else if f == nil {
+			conf.obsolete[key] = val
+			continue
+		}
+		elem := normalizeValue(f, val)
+		if _, isList := o.lists[name]; !isList && o.unset != "" && val == o.unset {
+			elem = f.DefValue
+		}
+		if err := o.fs.Set(name, elem); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q for flag %s: %w", val, name, err))
+			continue
+		}
+		conf.raw[name] = rawValue{val, valueString(f)}
+	}
+	return conf, errors.Join(errs...)
+}
+
+// userComments returns the comment lines preceding a key without the ones
+// generated by saveConfig. The comments directly above the key are dropped if
+// they end with the usage comment of the flag. If the usage of the flag
+// changed since, only the last line of its former usage comment is dropped,
+// which is recognized by ending with stale, the type and default of the flag
+// in parentheses, see usageText. An empty stale matches nothing. Leading
+// empty lines are dropped and runs of empty lines are collapsed.
+func userComments(lines, usage []string, stale, prefix string) []string {
+	var res []string
+	for _, line := range lines {
+		if line != "" || (len(res) > 0 && res[len(res)-1] != "") {
+			res = append(res, line)
+		}
+	}
+
+	// the paragraph directly preceding the key
+	start := 0
+	for i, line := range res {
+		if line == "" {
+			start = i + 1
+		}
+	}
+	last := res[start:]
+	if n := len(last) - len(usage); len(usage) > 0 && n >= 0 && equalLines(last[n:], usage) {
+		res = res[:start+n]
+	} else if n := len(last); n > 0 && stale != "" && strings.HasPrefix(last[n-1], prefix) && strings.HasSuffix(last[n-1], " "+stale) {
+		res = res[:len(res)-1]
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// indexSeparator returns the index of the separator between key and value in
+// line, or -1 if there is none. Unless a separator is configured, the first =
+// is used, or the first : if there is no = before a trailing comment.
+func indexSeparator(line string, o *options) int {
+	if o.separator != 0 {
+		return strings.IndexByte(line, o.separator)
+	}
+	if i := strings.IndexByte(line[:commentIndex(line, o.commentPrefix)], '='); i != -1 {
+		return i
+	}
+	return strings.IndexByte(line, ':')
+}
+
+// defaultMaxLine is the default limit of the line length, see
+// WithMaxLineLength.
+const defaultMaxLine = 1 << 20
+
+// newLineScanner returns a scanner of the lines of r split by scanLines,
+// which fails for lines longer than max bytes.
+func newLineScanner(r io.Reader, max int) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := scanLines(data, atEOF)
+		if err == nil && len(token) > max {
+			return 0, nil, bufio.ErrTooLong
+		}
+		return advance, token, err
+	})
+	// room for the line ending
+	scanner.Buffer(nil, max+2)
+	return scanner
+}
+
+// scanError returns the error of a scanner, which failed after lineNum lines,
+// naming the line which exceeded max bytes.
+func scanError(err error, lineNum, max int) error {
+	if errors.Is(err, bufio.ErrTooLong) {
+		return fmt.Errorf("line %d: %w, the limit is %d bytes", lineNum+1, err, max)
+	}
+	return err
+}
+
+// scanLines is a bufio.SplitFunc like bufio.ScanLines, but besides \n and
+// \r\n a lone \r ends a line as well, so files edited on any platform are
+// read the same.
+func scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\n' {
+			return i + 1, data[:i], nil
+		}
+		// a \r at the end of the buffer may be followed by a \n
+		if i+1 == len(data) && !atEOF {
+			return 0, nil, nil
+		}
+		if i+1 < len(data) && data[i+1] == '\n' {
+			return i + 2, data[:i], nil
+		}
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// splitSection splits name at its first dot into the section and the key
+// within that section. Names without a dot belong to no section.
+func splitSection(name string) (section, key string) {
+	if i := strings.Index(name, "."); i > 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+// continues reports whether line ends with an odd number of backslashes,
+// i.e. with a backslash that is not itself escaped.
+func continues(line string) bool {
+	n := len(line) - len(strings.TrimRight(line, `\`))
+	return n%2 == 1
+}
+
+// saveConfig writes the flags and obsolete keys to w. Flag values that did not
+// change since they were read from the config file are written as they were,
+// e.g. without expanding environment variables again. Values are compared as
+// reported by the flags, so other spellings of the same value, like 1.50 for
+// a float flag of 1.5 or 0x1F90 for an int flag of 8080, are kept as well.
+func saveConfig(o *options, w io.Writer, conf *config) {
+	if conf == nil {
+		conf = &config{}
+	}
+
+	if v := o.fileVersion(conf); v > 0 {
+		fmt.Fprintln(w)
+		for _, line := range conf.versionComments.before {
+			fmt.Fprintln(w, line)
+		}
+		fmt.Fprintln(w, versionKey+string(o.writeSeparator())+strconv.Itoa(v)+inlineComment(conf.versionComments))
+	}
+
+	// includes are written before the flag they preceded, top-level includes
+	// missing that flag at the end of the top level
+	pos := make(map[sharedKey]int)
+	for i, name := range conf.order {
+		if f := o.fs.Lookup(name); f != nil {
+			if _, ok := pos[keyOf(f)]; !ok {
+				pos[keyOf(f)] = i
+			}
+		}
+	}
+	includes := conf.includes
+	writeIncludes := func(before int) {
+		for ; len(includes) > 0 && includes[0].pos <= before; includes = includes[1:] {
+			fmt.Fprintln(w)
+			for _, line := range includes[0].comments.before {
+				fmt.Fprintln(w, line)
+			}
+			fmt.Fprintln(w, wrapLine(includeKey+string(o.writeSeparator())+includes[0].text+inlineComment(includes[0].comments), o.wrap, o.commentPrefix))
+		}
+	}
+
+	sections, grouped := groupSections(orderFlags(o, savedFlags(o), conf.order))
+	if o.deprecated == DeprecatedTop && len(conf.obsolete) > 0 {
+		writeObsolete(o, w, conf, false)
+		fmt.Fprintf(w, "%s %s\n", o.commentPrefix, obsoleteEnd)
+	}
+	for _, section := range sections {
+		if section != "" {
+			writeIncludes(len(conf.order))
+			fmt.Fprintf(w, "\n[%s]\n", o.fileKey(section))
+		}
+		category := -1
+		for _, f := range o.sortCategories(grouped[section]) {
+			if section == "" {
+				i, ok := pos[keyOf(&f)]
+				if !ok {
+					i = len(conf.order)
+				}
+				writeIncludes(i)
+			}
+			if c := o.categories[f.Name]; len(o.categoryOrder) > 0 && c != category {
+				fmt.Fprintf(w, "\n%s\n", o.categoryHeader(c))
+				category = c
+			}
+			_, key := splitSection(f.Name)
+			key = o.fileKey(key)
+			fmt.Fprintln(w)
+			for _, line := range conf.comments[f.Name].before {
+				fmt.Fprintln(w, line)
+			}
+			fmt.Fprintln(w, usageComment(o, &f))
+			line := conf.line(o, key, f.Name, valueString(&f))
+			if o.secrets[f.Name] {
+				line = key + string(o.writeSeparator()) + conf.secretText(&f) + inlineComment(conf.comments[f.Name])
+			} else if sep, ok := o.lists[f.Name]; ok {
+				line = key + string(o.writeSeparator()) + conf.listText(&f, sep, o.commentPrefix) + inlineComment(conf.comments[f.Name])
+			}
+			// flags at their default or set by base files only are suggested
+			_, inFile := conf.raw[f.Name]
+			if o.omitDefaults && f.Value.String() == f.DefValue || o.inherited[f.Name] && !inFile {
+				fmt.Fprintln(w, o.commentPrefix, line)
+				continue
+			}
+			fmt.Fprintln(w, wrapLine(line, o.wrap, o.commentPrefix))
+		}
+	}
+
+	writeIncludes(len(conf.order))
+
+	for _, p := range conf.profiles {
+		lines := p.lines
+		for len(lines) > p.header+1 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+			lines = lines[:len(lines)-1]
+		}
+		fmt.Fprintf(w, "\n%s\n", strings.Join(lines, "\n"))
+	}
+
+	// if we have obsolete keys left from the old config, preserve them in an
+	// additional section at the end of the file
+	if o.deprecated == DeprecatedBottom && len(conf.obsolete) > 0 {
+		writeObsolete(o, w, conf, len(sections) > 1 || len(conf.profiles) > 0)
+	}
+
+	if len(conf.trailing) > 0 {
+		fmt.Fprintf(w, "\n%s\n", strings.Join(conf.trailing, "\n"))
+	}
+}
+
+// readObsolete applies the file of obsolete keys at path to the flags and adds
+// its remaining obsolete keys to conf, see DeprecatedFile. The keys of conf
+// take precedence. Besides the content of the file, it reports whether it
+// exists.
+func readObsolete(o *options, path string, conf *config) ([]byte, bool, error) {
+	f, err := o.openFile(path, os.O_RDONLY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, tagError(ErrOpen, fmt.Errorf("unable to open %s config file %v for reading: %w", o.appName, path, err))
+	}
+	defer closeFile(f)
+	if err := o.checkFile(path, f); err != nil {
+		return nil, false, err
+	}
+	content, err := io.ReadAll(ctxReader{o.ctx, f})
+	if err != nil {
+		return nil, false, tagError(ErrOpen, fmt.Errorf("failed to read %s: %w", path, err))
+	}
+
+	skip := make(map[string]bool)
+	for key := range conf.raw {
+		skip[key] = true
+	}
+	obsolete, err := parseConfigFile(o, bytes.NewReader(content), rootIncludes(o), skip)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to parse %s:\n%w", path, err)
+	}
+	for key, val := range obsolete.obsolete {
+		conf.obsolete[key] = val
+		conf.comments[key] = obsolete.comments[key]
+	}
+	return content, true, nil
+}
+
+// writeObsolete writes the obsolete keys of conf to w, introduced by the
+// banner. If reset is set, they are preceded by an empty section to reset the
+// current one.
+func writeObsolete(o *options, w io.Writer, conf *config, reset bool) {
+	fmt.Fprintf(w, "\n\n%s %s\n", o.commentPrefix, obsoleteBanner)
+	if reset {
+		fmt.Fprintln(w, "[]")
+	}
+	for _, key := range sortedKeys(conf.obsolete) {
+		val := conf.obsolete[key]
+		for _, line := range conf.comments[key].before {
+			fmt.Fprintln(w, line)
+		}
+		for _, line := range o.deprecationComment(key) {
+			fmt.Fprintln(w, line)
+		}
+		if o.commentObs {
+			fmt.Fprintf(w, "%s %s  %s\n", o.commentPrefix, conf.line(o, key, key, val), obsoleteMark)
+			continue
+		}
+		fmt.Fprintln(w, wrapLine(conf.line(o, key, key, val), o.wrap, o.commentPrefix))
+	}
+}
+
+// savedFlags returns the flags to write to the config file in lexicographical
+// order. Of flags pointing to the same variable, only the longest named flag
+// is written, the shorthand versions are ignored.
+func savedFlags(o *options) []flag.Flag {
+	deduped := make(map[sharedKey]flag.Flag)
+	o.fs.VisitAll(func(f *flag.Flag) {
+		if cur, ok := deduped[keyOf(f)]; !ok || utf8.RuneCountInString(f.Name) > utf8.RuneCountInString(cur.Name) {
+			deduped[keyOf(f)] = *f
+		}
+	})
+	var flags []flag.Flag
+	o.fs.VisitAll(func(f *flag.Flag) {
+		if cur, ok := deduped[keyOf(f)]; ok && cur.Name == f.Name {
+			flags = append(flags, *f)
+		}
+	})
+	return flags
+}
+
+// sharedKey identifies the variable of a flag, so flags sharing a variable
+// like a shorthand and its long version can be detected. Only pointers are
+// compared, as other values like those of flag.Func may not be comparable
+// and cannot share a variable anyway.
+type sharedKey struct {
+	ptr  flag.Value
+	name string
+}
+
+func keyOf(f *flag.Flag) sharedKey {
+	if reflect.ValueOf(f.Value).Kind() == reflect.Ptr {
+		return sharedKey{ptr: f.Value}
+	}
+	return sharedKey{name: f.Name}
+}
+
+// orderFlags sorts the flags named in order, or sharing their variable with a
+// flag named in order, to the front in that order. The other flags keep their
+// order after them, so flags missing from the config file are appended.
+func orderFlags(o *options, flags []flag.Flag, order []string) []flag.Flag {
+	pos := make(map[sharedKey]int)
+	for i, name := range order {
+		if f := o.fs.Lookup(name); f != nil {
+			if _, ok := pos[keyOf(f)]; !ok {
+				pos[keyOf(f)] = i
+			}
+		}
+	}
+	sort.SliceStable(flags, func(i, j int) bool {
+		pi, iok := pos[keyOf(&flags[i])]
+		pj, jok := pos[keyOf(&flags[j])]
+		if iok && jok {
+			return pi < pj
+		}
+		return iok && !jok
+	})
+	return flags
+}
+
+// sortedKeys returns the keys of m in lexicographical order, keeping the
+// written files unchanged between runs.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// groupSections groups flags by the section named by their dotted prefix.
+// Flags without a prefix belong to the section "", which is always the first
+// of the returned sections.
+func groupSections(flags []flag.Flag) ([]string, map[string][]flag.Flag) {
+	sections := []string{""}
+	grouped := make(map[string][]flag.Flag)
+	for _, f := range flags {
+		section, _ := splitSection(f.Name)
+		if _, ok := grouped[section]; !ok && section != "" {
+			sections = append(sections, section)
+		}
+		grouped[section] = append(grouped[section], f)
+	}
+	return sections, grouped
+}
+
+// typedValue returns the value of f as bool or number if it is one of the
+// standard flags of those types, or as string otherwise.
+func typedValue(f *flag.Flag) interface{} {
+	if g, ok := f.Value.(flag.Getter); ok {
+		switch v := g.Get().(type) {
+		case bool, int, int64, uint, uint64, float64:
+			return v
+		}
+	}
+	return valueString(f)
+}
+
+// valueString returns the value of f as written to the config file. Durations
+// are written without zero minutes and seconds, e.g. 1h30m instead of
+// 1h30m0s, as flag.Duration accepts both.
+func valueString(f *flag.Flag) string {
+	if d, ok := durationValue(f); ok {
+		return formatDuration(d)
+	}
+	return f.Value.String()
+}
+
+// normalizeValue prepares the value val read from the config file to be set
+// on f. Spaces are removed from durations, so "1h 30m" is accepted as well,
+// and booleans may be written as yes, on and enabled or no, off and disabled.
+func normalizeValue(f *flag.Flag, val string) string {
+	if _, ok := durationValue(f); ok {
+		return strings.Join(strings.Fields(val), "")
+	}
+	if isBoolFlag(f) {
+		switch strings.ToLower(val) {
+		case "yes", "on", "enabled":
+			return "true"
+		case "no", "off", "disabled":
+			return "false"
+		}
+	}
+	return val
+}
+
+// isBoolFlag reports whether f is a boolean flag, which may be given without
+// value on the command line.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// durationValue returns the value of f if it is a flag.Duration.
+func durationValue(f *flag.Flag) (time.Duration, bool) {
+	if g, ok := f.Value.(flag.Getter); ok {
+		d, ok := g.Get().(time.Duration)
+		return d, ok
+	}
+	return 0, false
+}
+
+// formatDuration formats d like time.Duration.String, but without trailing
+// zero units, e.g. 1h instead of 1h0m0s.
+func formatDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// usageComment returns the comment describing the flag f in the config file.
+// The defaults of secret flags are masked.
+func usageComment(o *options, f *flag.Flag) string {
+	return commentLines(o.commentPrefix, usageText(maskDefault(o, f)))
+}
+
+// flagComments returns the comment lines preceding the key of f without the
+// ones generated by saveConfig, see userComments. Usage comments written before
+// the type of the flags was documented are dropped as well.
+func flagComments(o *options, f *flag.Flag, lines []string) []string {
+	usage := strings.Split(usageComment(o, f), "\n")
+	text, name, def := usageParts(maskDefault(o, f))
+	legacy := strings.Split(commentLines(o.commentPrefix, text+" "+typeDefault("", def)), "\n")
+	if n := len(lines) - len(legacy); name != "" && n >= 0 && equalLines(lines[n:], legacy) {
+		usage = legacy
+	}
+	return userComments(lines, usage, typeDefault(name, def), o.commentPrefix)
+}
+
+// maskDefault returns f with the default value masked if it is a secret, see
+// WithSecret.
+func maskDefault(o *options, f *flag.Flag) *flag.Flag {
+	if o.secrets[f.Name] && f.DefValue != "" {
+		masked := *f
+		masked.DefValue = secretPlaceholder
+		return &masked
+	}
+	return f
+}
+
+// usageText returns the usage of f together with its type, if known, and its
+// default value.
+func usageText(f *flag.Flag) string {
+	usage, name, def := usageParts(f)
+	return usage + " " + typeDefault(name, def)
+}
+
+// usageParts returns the usage of f, the name of its type, which is empty if
+// unknown, and its default value as written to the usage comment.
+func usageParts(f *flag.Flag) (usage, name, def string) {
+	if v, ok := f.Value.(*defaultValue); ok {
+		typed := *f
+		typed.Value = v.of
+		f = &typed
+	}
+	name, usage = flag.UnquoteUsage(f)
+	usage = strings.Replace(usage, "\n    \t", "\n", -1)
+	def = f.DefValue
+	if _, ok := durationValue(f); ok {
+		if d, err := time.ParseDuration(def); err == nil {
+			def = formatDuration(d)
+		}
+	}
+	// the type is unknown for custom flag.Values without a name in the usage
+	if name == "" && isBoolFlag(f) {
+		name = "bool"
+	} else if name == "value" {
+		name = ""
+	}
+	return usage, name, def
+}
+
+// typeDefault returns the type name and the default value in parentheses, as
+// written at the end of usage comments.
+func typeDefault(name, def string) string {
+	if name == "" {
+		return fmt.Sprintf("(default %v)", def)
+	}
+	return fmt.Sprintf("(%s, default %v)", name, def)
+}
+
+// wrapLine breaks line into several lines joined by backslash continuation if
+// it is longer than width. Lines are never broken inside an escape sequence or
+// before whitespace, which would be trimmed when reading the line back.
+func wrapLine(line string, width int, prefix string) string {
+	if width < 2 || utf8.RuneCountInString(line) <= width {
+		return line
+	}
+	var b strings.Builder
+	col, keep := 0, 0
+	for i, r := range line {
+		// keep escape sequences together and leave room for the backslash
+		need, n := 2, 0
+		if r == '\\' && keep == 0 {
+			n = utf8.RuneCountInString(line[i+1:][:escapeLen(line[i+1:], prefix)])
+			need += n
+		}
+		if col+need > width && keep == 0 && !unicode.IsSpace(r) {
+			b.WriteString("\\\n")
+			col = 0
+		}
+		b.WriteRune(r)
+		col++
+		if keep > 0 {
+			keep--
+		} else {
+			keep = n
+		}
+	}
+	return b.String()
+}
+
+// escapeLen returns the length of the escaped text following a backslash,
+// which is the comment prefix if rest starts with it, see unescape, or a
+// single byte otherwise.
+func escapeLen(rest, prefix string) int {
+	if prefix != "" && strings.HasPrefix(rest, prefix) {
+		return len(prefix)
+	} else if rest == "" {
+		return 0
+	}
+	return 1
+}
+
+// parseValue interprets the raw value of a config line. An unquoted comment
+// prefix preceded by whitespace starts a comment which is not part of the
+// value, see commentIndex. Leading whitespace is ignored. Values enclosed in
+// single quotes are used literally, including surrounding whitespace. Values
+// enclosed in double quotes and unquoted values have their backslash escapes
+// decoded, see unescape. Besides the value, the length of the value's text in
+// val is returned, i.e. the index where a trailing comment could start.
+func parseValue(val, prefix string) (string, int, error) {
+	trimmed := strings.TrimLeft(val, " \t")
+	if trimmed == "" || (trimmed[0] != '"' && trimmed[0] != '\'') {
+		n := commentIndex(val, prefix)
+		return unescape(strings.TrimSpace(val[:n]), prefix), n, nil
+	}
+	offset := len(val) - len(trimmed)
+	val = trimmed
+
+	// find the closing quote, skipping escaped characters in double quotes
+	end := -1
+	for i := 1; i < len(val) && end == -1; i++ {
+		if val[i] == '\\' && val[0] == '"' {
+			i++
+		} else if val[i] == val[0] {
+			end = i
+		}
+	}
+	if end == -1 {
+		return "", 0, fmt.Errorf("unterminated quote in %s", val)
+	}
+	if rest := strings.TrimSpace(val[end+1:]); rest != "" && !strings.HasPrefix(rest, prefix) {
+		return "", 0, fmt.Errorf("unexpected %s after quoted value", rest)
+	}
+	if val[0] == '\'' {
+		return val[1:end], offset + end + 1, nil
+	}
+	return unescape(val[1:end], prefix), offset + end + 1, nil
+}
+
+// expandEnv replaces ${VAR} and $VAR in val with the value of the environment
+// variable VAR, $$ is replaced by a single $. Unset variables expand to the
+// empty string or cause an error if strict is set.
+func expandEnv(val string, strict bool) (string, error) {
+	var err error
+	val = os.Expand(val, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		env, ok := os.LookupEnv(name)
+		if !ok && strict && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return env
+	})
+	return val, err
+}
+
+// commentIndex returns the index of the first unescaped comment prefix in val
+// which starts a comment, or len(val) if there is none. Like in env files, the
+// prefix only starts a comment after whitespace, e.g. color=#fff is kept.
+func commentIndex(val, prefix string) int {
+	for i := 0; i < len(val); i++ {
+		if val[i] == '\\' {
+			i += escapeLen(val[i+1:], prefix)
+		} else if startsComment(val, i, prefix) {
+			return i
+		}
+	}
+	return len(val)
+}
+
+// startsComment reports whether the comment prefix at index i of text starts
+// a comment, see commentIndex.
+func startsComment(text string, i int, prefix string) bool {
+	return i > 0 && (text[i-1] == ' ' || text[i-1] == '\t') && strings.HasPrefix(text[i:], prefix)
+}
+
+// formatValue is the inverse of parseValue and expandEnv. Special characters
+// are escaped and the value is enclosed in double quotes if it has surrounding
+// whitespace or starts or ends with a quote character.
+func formatValue(val, prefix string) string {
+	val = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`, "\t", `\t`, prefix, `\`+prefix, "$", "$$").Replace(val)
+	if val != strings.TrimSpace(val) ||
+		strings.HasPrefix(val, `"`) || strings.HasPrefix(val, "'") ||
+		strings.HasSuffix(val, `"`) || strings.HasSuffix(val, "'") {
+		return `"` + strings.Replace(val, `"`, `\"`, -1) + `"`
+	}
+	return val
+}
+
+// unescape decodes the escape sequences \n, \r, \t, \\, \# and \" as well as a
+// backslash followed by the comment prefix. A backslash followed by anything
+// else is preserved verbatim.
+func unescape(val, prefix string) string {
+	if !strings.Contains(val, `\`) {
+		return val
+	}
+	var b strings.Builder
+	for i := 0; i < len(val); i++ {
+		if val[i] != '\\' || i+1 == len(val) {
+			b.WriteByte(val[i])
+			continue
+		}
+		if strings.HasPrefix(val[i+1:], prefix) {
+			b.WriteString(prefix)
+			i += len(prefix)
+			continue
+		}
+		switch val[i+1] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case '\\', '#', '"':
+			b.WriteByte(val[i+1])
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(val[i+1])
 		}
+		i++
 	}
+	return b.String()
 }
@@ -1,13 +1,24 @@
 package confy
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -23,7 +34,7 @@ obsdup=4
 obsdup=5`
 	wantSavedNil = `
 # shorthand test
-# (longhand) (default 3)
+# (longhand) (int, default 3)
 really-long-hand=3
 `
 	wantSavedEmpty = ``
@@ -46,7 +57,10 @@ func TestParseConfig(t *testing.T) {
 	shorthand := flag.Int("shorthand", 3, "shorthand test")
 	flag.IntVar(shorthand, "s", 3, "shorthand test (shorthand)")
 
-	obsKeys := parseConfig(bytes.NewBufferString(testfile))
+	conf, err := parseConfig(newOptions("confy_test", nil), bytes.NewBufferString(testfile))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
 
 	if *comment != 3 {
 		t.Errorf("`#comment` flag should not be populated")
@@ -63,96 +77,3864 @@ func TestParseConfig(t *testing.T) {
 	if *shorthand != 4 {
 		t.Errorf("shorthand assignment not working")
 	}
-	if obsKeys["obs"] != "4" {
+	if conf.obsolete["obs"] != "4" {
 		t.Errorf("obsolete key not parsed")
 	}
-	if obsKeys["obsdup"] != "5" {
+	if conf.obsolete["obsdup"] != "5" {
 		t.Errorf("the last occurring entry of duplicate obsolete flags from the file should be used")
 	}
 }
 
-func TestSaveConfig(t *testing.T) {
+func TestQuotedValues(t *testing.T) {
 	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	double := flag.String("double", "", "double quotes")
+	single := flag.String("single", "", "single quotes")
+	inner := flag.String("inner", "", "inner quotes")
+	flag.String("hash", "a # b", "hash")
+
+	_, err := parseConfig(newOptions("confy_test", nil), bytes.NewBufferString(`
+double="  hunter2  "
+single='=: x '
+inner= "say \"hi\"" # comment`))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *double != "  hunter2  " {
+		t.Errorf("double quotes: (want: %q; got: %q)", "  hunter2  ", *double)
+	}
+	if *single != "=: x " {
+		t.Errorf("single quotes: (want: %q; got: %q)", "=: x ", *single)
+	}
+	if *inner != `say "hi"` {
+		t.Errorf("inner quotes: (want: %q; got: %q)", `say "hi"`, *inner)
+	}
 
 	resWriter := new(bytes.Buffer)
-	obsKeys := make(map[string]string)
-	saveConfig(resWriter, obsKeys)
-	got := resWriter.String()
-	if got != wantSavedEmpty {
-		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", wantSavedEmpty, got)
+	saveConfig(newOptions("confy_test", nil), resWriter, nil)
+	for _, want := range []string{"\ndouble=\"  hunter2  \"\n", "\nhash=a \\# b\n", "\ninner=\"say \\\"hi\\\"\"\n", "\nsingle=\"=: x \"\n"} {
+		if !strings.Contains(resWriter.String(), want) {
+			t.Errorf("saved config is missing %q:\n%s", want, resWriter.String())
+		}
 	}
 
-	resWriter = new(bytes.Buffer)
-	obsKeys["obs"] = "4"
-	saveConfig(resWriter, obsKeys)
-	got = resWriter.String()
-	if got != wantSavedObs {
-		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", wantSavedObs, got)
+	for _, line := range []string{`double="abc`, `double='abc"`, `double="`, `double="a" b`, `double="a\"`} {
+		if _, err := parseConfig(newOptions("confy_test", nil), bytes.NewBufferString(line)); err == nil {
+			t.Errorf("expected an error for unterminated quotes in %s", line)
+		}
 	}
+}
 
-	resWriter = new(bytes.Buffer)
-	shorthand := flag.Int("shorthand", 3, "shorthand test")
-	flag.IntVar(shorthand, "s", 3, "shorthand test (shorthand)")
-	flag.IntVar(shorthand, "really-long-hand", 3, "shorthand test\n    \t(longhand)")
-	saveConfig(resWriter, nil)
-	got = resWriter.String()
-	if got != wantSavedNil {
-		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", wantSavedNil, got)
+func TestEscapedValues(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	text := flag.String("text", "", "escapes")
+	raw := flag.String("raw", "", "no escapes")
+
+	_, err := parseConfig(newOptions("confy_test", nil), bytes.NewBufferString(`
+text=a\nb\tc\\d\#e\xf
+raw='a\nb'`))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if want := "a\nb\tc\\d#e\\xf"; *text != want {
+		t.Errorf("escapes: (want: %q; got: %q)", want, *text)
+	}
+	if want := `a\nb`; *raw != want {
+		t.Errorf("single quotes: (want: %q; got: %q)", want, *raw)
+	}
+
+	// round-trip a value containing a newline
+	for _, want := range []string{"first\nsecond", " \t\\n#\n "} {
+		*text = want
+		resWriter := new(bytes.Buffer)
+		saveConfig(newOptions("confy_test", nil), resWriter, nil)
+		*text = ""
+		if _, err := parseConfig(newOptions("confy_test", nil), resWriter); err != nil {
+			t.Fatalf("unexpected error occurred: %v", err)
+		}
+		if *text != want {
+			t.Errorf("round-trip: (want: %q; got: %q)", want, *text)
+		}
 	}
 }
 
-func TestParse(t *testing.T) {
-	// pipe stderr to a temporary file
-	oldErr := os.Stderr
-	var err error
-	if os.Stderr, err = ioutil.TempFile("", "confy_test_err"); err != nil {
-		t.Fatalf("failed to redirect stderr to tempfile")
+func TestInlineComments(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	port := flag.Int("port", 0, "port")
+	color := flag.String("color", "", "escaped hash")
+	quoted := flag.String("quoted", "", "quoted hash")
+	single := flag.String("single", "", "single quoted hash")
+	hex := flag.String("hex", "", "hash without whitespace")
+	password := flag.String("password", "", "hash within the value")
+	empty := flag.String("empty", "x", "comment only")
+
+	conf, err := parseConfig(newOptions("confy_test", nil), bytes.NewBufferString(`
+port=8080 # main listener
+color=\#fff #white
+quoted="a # b"   # comment
+single='#'#
+hex=#fff
+password=ab#cd	# tab
+empty= # nothing`))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if len(conf.obsolete) != 0 {
+		t.Errorf("no obsolete keys expected, got: %v", conf.obsolete)
+	}
+	if *port != 8080 {
+		t.Errorf("port: (want: %d; got: %d)", 8080, *port)
+	}
+	if *color != "#fff" {
+		t.Errorf("color: (want: %q; got: %q)", "#fff", *color)
+	}
+	if *quoted != "a # b" {
+		t.Errorf("quoted: (want: %q; got: %q)", "a # b", *quoted)
+	}
+	if *single != "#" {
+		t.Errorf("single: (want: %q; got: %q)", "#", *single)
+	}
+	if *hex != "#fff" || *password != "ab#cd" || *empty != "" {
+		t.Errorf("unexpected values: %q, %q, %q", *hex, *password, *empty)
+	}
+}
+
+func TestContinuedLines(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	allow := flag.String("allow", "", "continued value")
+	path := flag.String("path", "", "escaped backslash at end of line")
+	port := flag.Int("port", 0, "line after a literal backslash")
+
+	_, err := parseConfig(newOptions("confy_test", nil), bytes.NewBufferString(`
+allow=a,\
+   b,\
+c
+path=C:\\
+port=80`))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *allow != "a,b,c" {
+		t.Errorf("allow: (want: %q; got: %q)", "a,b,c", *allow)
+	}
+	if *path != `C:\` {
+		t.Errorf("path: (want: %q; got: %q)", `C:\`, *path)
+	}
+	if *port != 80 {
+		t.Errorf("port: (want: %d; got: %d)", 80, *port)
+	}
+
+	// round-trip long values wrapped at 20 columns
+	o := newOptions("confy_test", []Option{WithWrap(20)})
+	for _, want := range []string{strings.Repeat("abc, ", 10), strings.Repeat(`\`, 30), strings.Repeat("a\nb#", 10)} {
+		*allow = want
+		resWriter := new(bytes.Buffer)
+		saveConfig(o, resWriter, nil)
+		for _, line := range strings.Split(resWriter.String(), "\n") {
+			if utf8.RuneCountInString(line) > 20 && !strings.HasPrefix(line, "#") {
+				t.Errorf("line exceeds 20 columns: %q", line)
+			}
+		}
+		*allow = ""
+		if _, err := parseConfig(newOptions("confy_test", nil), resWriter); err != nil {
+			t.Fatalf("unexpected error occurred: %v", err)
+		}
+		if *allow != want {
+			t.Errorf("round-trip: (want: %q; got: %q)", want, *allow)
+		}
+	}
+}
+
+func TestSections(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flag.String("name", "", "top level")
+	host := flag.String("db.host", "", "database host")
+	flag.Int("db.port", 0, "database port")
+	level := flag.String("log.level", "", "log level")
+
+	conf, err := parseConfig(newOptions("confy_test", nil), bytes.NewBufferString(`
+[db]
+host=localhost
+[ log ]
+level=debug
+[]
+obs=4`))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *host != "localhost" {
+		t.Errorf("db.host: (want: %q; got: %q)", "localhost", *host)
+	}
+	if *level != "debug" {
+		t.Errorf("log.level: (want: %q; got: %q)", "debug", *level)
+	}
+	if conf.obsolete["obs"] != "4" {
+		t.Errorf("obsolete key after [] not parsed: %v", conf.obsolete)
+	}
+
+	resWriter := new(bytes.Buffer)
+	saveConfig(newOptions("confy_test", nil), resWriter, conf)
+	want := `
+# top level (string, default )
+name=
+
+[db]
+
+# database host (string, default )
+host=localhost
+
+# database port (int, default 0)
+port=0
+
+[log]
+
+# log level (string, default )
+level=debug
+
+
+# The following options are probably deprecated and not used currently!
+[]
+obs=4
+`
+	if got := resWriter.String(); got != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+	}
+}
+
+func TestEnvExpansion(t *testing.T) {
+	os.Setenv("CONFY_TEST_HOST", "db.example.com")
+	defer os.Unsetenv("CONFY_TEST_HOST")
+	os.Unsetenv("CONFY_TEST_UNSET")
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	host := flag.String("host", "", "expanded")
+	url := flag.String("url", "", "expanded inside text")
+	price := flag.String("price", "", "literal dollar")
+	unset := flag.String("unset", "x", "unset variable")
+	single := flag.String("single", "", "single quotes")
+
+	testfile := `
+host=${CONFY_TEST_HOST}
+url="http://$CONFY_TEST_HOST:80"
+price=5$$
+unset=$CONFY_TEST_UNSET
+single='$CONFY_TEST_HOST'`
+	conf, err := parseConfig(newOptions("confy_test", nil), bytes.NewBufferString(testfile))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	for _, c := range []struct{ got, want string }{
+		{*host, "db.example.com"},
+		{*url, "http://db.example.com:80"},
+		{*price, "5$"},
+		{*unset, ""},
+		{*single, "$CONFY_TEST_HOST"},
+	} {
+		if c.got != c.want {
+			t.Errorf("expansion: (want: %q; got: %q)", c.want, c.got)
+		}
+	}
+
+	// unchanged values are written back unexpanded, changed ones escaped
+	*price = "6$"
+	resWriter := new(bytes.Buffer)
+	saveConfig(newOptions("confy_test", nil), resWriter, conf)
+	for _, want := range []string{"\nhost=${CONFY_TEST_HOST}\n", "\nprice=6$$\n", "\nsingle='$CONFY_TEST_HOST'\n"} {
+		if !strings.Contains(resWriter.String(), want) {
+			t.Errorf("saved config is missing %q:\n%s", want, resWriter.String())
+		}
+	}
+
+	if _, err := parseConfig(newOptions("confy_test", []Option{WithStrictEnv(true)}), bytes.NewBufferString(testfile)); err == nil || !strings.Contains(err.Error(), "CONFY_TEST_UNSET") {
+		t.Errorf("expected an error about CONFY_TEST_UNSET in strict mode, got: %v", err)
+	}
+}
+
+func TestCaseInsensitiveKeys(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	port := flag.Int("port", 0, "lower case flag")
+	level := flag.String("log-level", "", "lower case flag with dash")
+	exact := flag.Int("Exact", 0, "exact match")
+	other := flag.Int("exact", 0, "exact match")
+
+	conf, err := parseConfig(newOptions("confy_test", nil), bytes.NewBufferString(`
+Port=8080
+LOG-LEVEL=debug
+Exact=1
+exact=2`))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if len(conf.obsolete) != 0 {
+		t.Errorf("no obsolete keys expected, got: %v", conf.obsolete)
+	}
+	if *port != 8080 || *level != "debug" {
+		t.Errorf("case-insensitive keys: (want: 8080, debug; got: %d, %s)", *port, *level)
+	}
+	if *exact != 1 || *other != 2 {
+		t.Errorf("exact matches: (want: 1, 2; got: %d, %d)", *exact, *other)
+	}
+
+	resWriter := new(bytes.Buffer)
+	saveConfig(newOptions("confy_test", nil), resWriter, conf)
+	for _, want := range []string{"\nport=8080\n", "\nlog-level=debug\n"} {
+		if !strings.Contains(resWriter.String(), want) {
+			t.Errorf("saved config is missing %q:\n%s", want, resWriter.String())
+		}
+	}
+}
+
+func TestLineErrors(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	port := flag.Int("port", 0, "int flag")
+	flag.Bool("debug", false, "bool flag")
+	name := flag.String("name", "", "string flag")
+
+	logged := new(bytes.Buffer)
+	conf, err := parseConfig(newOptions("confy_test", []Option{WithWriter(logged)}), bytes.NewBufferString(`# comment
+port=abc
+unknown=abc
+debug=\
+  maybe
+name="unterminated
+name=ok`))
+	if err == nil {
+		t.Fatalf("expected an error for invalid values")
+	}
+	want := "line 2: invalid value \"abc\" for flag port: parse error\n" +
+		"line 4: invalid value \"maybe\" for flag debug: parse error\n" +
+		"line 6: invalid value for name: unterminated quote in \"unterminated"
+	if err.Error() != want {
+		t.Errorf("unexpected error:\nWANT:\n%s\n\nGOT:\n%s\n", want, err)
+	}
+	var lineErr *LineError
+	if !errors.As(err, &lineErr) || lineErr.Line != 2 || lineErr.Key != "port" || lineErr.Value != "abc" {
+		t.Errorf("expected a LineError for line 2, got: %#v", lineErr)
+	}
+	if *port != 0 || *name != "ok" {
+		t.Errorf("valid lines should still be applied: (want: 0, ok; got: %d, %s)", *port, *name)
+	}
+	if len(conf.obsolete) != 1 || conf.obsolete["unknown"] != "abc" {
+		t.Errorf("unknown keys should still be obsolete, got: %v", conf.obsolete)
+	}
+	// an invalid line doesn't count as a previous assignment of its key
+	if logged.Len() != 0 {
+		t.Errorf("unexpected warnings:\n%s", logged)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	host := flag.String("host", "", "host")
+
+	conf, err := parseConfig(newOptions("confy_test", []Option{WithStrict(true)}), bytes.NewBufferString(`
+hsot=localhost
+host=example.com`))
+	if err == nil || err.Error() != "line 2: unknown key hsot" {
+		t.Errorf("expected unknown key error, got: %v", err)
+	}
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected error to match ErrUnknownKey")
+	}
+	if len(conf.obsolete) != 0 {
+		t.Errorf("no obsolete keys expected in strict mode, got: %v", conf.obsolete)
+	}
+	if *host != "example.com" {
+		t.Errorf("host: (want: example.com; got: %s)", *host)
+	}
+}
+
+func TestDuplicateKeys(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	port := flag.Int("port", 0, "duplicate key")
+
+	logged := new(bytes.Buffer)
+	file := "port=1\nPort=2\nobs=1\nobs=2"
+	conf, err := parseConfig(newOptions("confy_test", []Option{WithWriter(logged)}), bytes.NewBufferString(file))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *port != 2 || conf.obsolete["obs"] != "2" {
+		t.Errorf("the last entry should be used: %d, %v", *port, conf.obsolete)
+	}
+	want := "WARNING: duplicate key port in line 2 overrides line 1\nWARNING: duplicate key obs in line 4 overrides line 3\n"
+	if logged.String() != want {
+		t.Errorf("unexpected warnings:\nWANT:\n%s\nGOT:\n%s", want, logged.String())
+	}
+
+	*port = 0
+	_, err = parseConfig(newOptions("confy_test", []Option{WithStrict(true)}), bytes.NewBufferString("port=1\n\nport=2"))
+	var lineErr *LineError
+	if !errors.Is(err, ErrDuplicateKey) || !errors.As(err, &lineErr) || lineErr.Line != 3 || lineErr.Key != "port" {
+		t.Fatalf("expected a duplicate key error in line 3, got: %v", err)
 	}
+	if want := "line 3: duplicate key port, first set in line 1"; err.Error() != want {
+		t.Errorf("error: (want: %q; got: %q)", want, err.Error())
+	}
+	if *port != 1 {
+		t.Errorf("port: (want: %d; got: %d)", 1, *port)
+	}
+}
+
+func TestMalformedLines(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
 	defer func() {
-		os.Stderr = oldErr
+		os.Args = oldArgs
 	}()
-	defer os.Remove(os.Stderr.Name())
 
+	dir, err := ioutil.TempDir("", "confy_test_malformed")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "config")
+	file := "port=1\njunk\ndebug\nhost localhost # the host\n[broken\n = 5\n"
+	if err := ioutil.WriteFile(cPath, []byte(file), 0600); err != nil {
+		t.Fatalf("failed to create config file")
+	}
+
+	fs := flag.NewFlagSet("malformed", flag.ContinueOnError)
+	port := fs.Int("port", 0, "port")
+	debug := fs.Bool("debug", false, "debug")
+	fs.String("host", "", "host")
+	res, err := ParseDetailed("confy_malformed", WithPath(cPath), WithFlagSet(fs), WithReadOnly(true))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *port != 1 || !*debug {
+		t.Errorf("unexpected values: %d, %v", *port, *debug)
+	}
+	if want := `map[2:junk 4:host localhost # the host 5:[broken 6:= 5]`; fmt.Sprint(res.IgnoredLines) != want {
+		t.Errorf("ignored lines: (want: %s; got: %v)", want, res.IgnoredLines)
+	}
+
+	fs = flag.NewFlagSet("malformed", flag.ContinueOnError)
+	fs.Int("port", 0, "port")
+	fs.Bool("debug", false, "debug")
+	fs.String("host", "", "host")
+	_, err = parseConfig(newOptions("confy_test", []Option{WithFlagSet(fs), WithStrict(true)}), bytes.NewBufferString(file))
+	var lineErr *LineError
+	if !errors.Is(err, ErrMalformedLine) || !errors.As(err, &lineErr) || lineErr.Line != 2 || lineErr.Value != "junk" {
+		t.Fatalf("expected a malformed line error in line 2, got: %v", err)
+	}
+	want := "line 2: malformed line \"junk\" without separator\nline 4: malformed line \"host localhost # the host\" without separator\nline 5: malformed line \"[broken\" without separator\nline 6: malformed line \"= 5\" without key"
+	if err.Error() != want {
+		t.Errorf("error: (want: %q; got: %q)", want, err.Error())
+	}
+
+	// values without key read by codecs are dropped as well
+	fs = flag.NewFlagSet("malformed", flag.ContinueOnError)
+	conf, err := applyValues(newOptions("confy_test", []Option{WithFlagSet(fs), WithWriter(io.Discard)}), map[string]string{"": "5"})
+	if err != nil || len(conf.obsolete) != 0 {
+		t.Errorf("unexpected result: %v, %v", err, conf.obsolete)
+	}
+	if _, err := applyValues(newOptions("confy_test", []Option{WithFlagSet(fs), WithStrict(true)}), map[string]string{"": "5"}); !errors.Is(err, ErrMalformedLine) {
+		t.Errorf("expected ErrMalformedLine, got: %v", err)
+	}
+}
+
+func TestCommentPrefix(t *testing.T) {
 	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
-	oldFlag := flag.Int("old", 3, "old flag")
-	openOrCreate = func(n string, l int, p os.FileMode) (*os.File, error) {
-		f, err := ioutil.TempFile("", "confy_testinf0")
-		if err == nil {
-			tmpFileName = f.Name()
+	port := flag.Int("port", 0, "port\n    \tsecond line")
+	url := flag.String("url", "", "url")
+	hash := flag.String("hash", "", "hash")
+
+	o := newOptions("confy_test", []Option{WithCommentPrefix("//")})
+	conf, err := parseConfig(o, bytes.NewBufferString(`
+// port=1
+port=8080 // main listener
+url=http:\//example.com
+hash=#1`))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *port != 8080 || *url != "http://example.com" || *hash != "#1" {
+		t.Errorf("unexpected values: %d, %s, %s", *port, *url, *hash)
+	}
+
+	*url = "https://example.com"
+	resWriter := new(bytes.Buffer)
+	saveConfig(o, resWriter, conf)
+	want := `
+// port=1
+// port
+// second line (int, default 0)
+port=8080 // main listener
+
+// url (string, default )
+url=https:\//example.com
+
+// hash (string, default )
+hash=#1
+`
+	if got := resWriter.String(); got != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+	}
+}
+
+func TestCommentPrefixRoundTrip(t *testing.T) {
+	for _, prefix := range []string{"//", "--", "§"} {
+		for _, width := range []int{0, 6} {
+			flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+			url := flag.String("url", "", "url")
+			o := newOptions("confy_test", []Option{WithCommentPrefix(prefix), WithWrap(width)})
+			for _, val := range []string{"file:///etc/x", "a" + prefix + prefix + prefix + "b", prefix + "x" + prefix} {
+				*url = val
+				resWriter := new(bytes.Buffer)
+				saveConfig(o, resWriter, nil)
+				*url = ""
+				if _, err := parseConfig(o, bytes.NewReader(resWriter.Bytes())); err != nil {
+					t.Fatalf("%s: unexpected error occurred: %v", prefix, err)
+				}
+				if *url != val {
+					t.Errorf("%s, width %d: (want: %q; got: %q) from:\n%s", prefix, width, val, *url, resWriter)
+				}
+			}
 		}
-		return f, err
 	}
-	if err := Parse("confy_test"); err != nil {
+}
+
+func TestSeparator(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	query := flag.String("query", "", "value with =")
+
+	o := newOptions("confy_test", []Option{WithSeparator(':')})
+	*query = "a=b"
+	resWriter := new(bytes.Buffer)
+	saveConfig(o, resWriter, nil)
+	if !strings.Contains(resWriter.String(), "\nquery:a=b\n") {
+		t.Errorf("unexpected result:\n%s", resWriter.String())
+	}
+	*query = ""
+	if _, err := parseConfig(o, resWriter); err != nil {
 		t.Fatalf("unexpected error occurred: %v", err)
 	}
-	defer os.Remove(tmpFileName)
+	if *query != "a=b" {
+		t.Errorf("round-trip: (want: %q; got: %q)", "a=b", *query)
+	}
 
-	if *oldFlag != 3 {
-		t.Errorf("oldFlag: (want: %d; got: %d)", 3, *oldFlag)
+	conf, err := parseConfig(o, bytes.NewBufferString("query=c"))
+	if err != nil || *query != "a=b" || conf.obsolete["query=c"] != "" || len(conf.obsolete) != 0 {
+		t.Errorf("= must not be accepted as separator: %v, %v", conf.obsolete, err)
 	}
+}
 
+func TestUserComments(t *testing.T) {
 	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
-	newFlag := flag.Int("new", 3, "new flag")
-	os.Setenv("CONFY_TESTINF0", tmpFileName)
-	openOrCreate = os.OpenFile
-	if err := Parse("confy_test"); err != nil {
+	flag.Int("port", 0, "listening port")
+	flag.String("host", "", "host name")
+	flag.String("user", "", "user name")
+
+	o := newOptions("confy_test", nil)
+	conf, err := parseConfig(o, bytes.NewBufferString(`# confy_test configuration
+# header line
+
+# about the host
+
+
+# set by the admin
+# old host usage (string, default )
+host=example.com
+
+# listening port (int, default 0)
+port=8080 # main listener
+# changed for the proxy
+user=admin
+
+# The following options are probably deprecated and not used currently!
+# no longer used
+obs=4
+
+# end of file
+`))
+	if err != nil {
 		t.Fatalf("unexpected error occurred: %v", err)
 	}
 
-	if *newFlag != 3 {
-		t.Errorf("newFlag: (want: %d; got: %d)", 3, *newFlag)
+	want := `
+# about the host
+
+# set by the admin
+# host name (string, default )
+host=example.com
+
+# listening port (int, default 0)
+port=8080 # main listener
+
+# changed for the proxy
+# user name (string, default )
+user=admin
+
+
+# The following options are probably deprecated and not used currently!
+# no longer used
+obs=4
+
+# end of file
+`
+	resWriter := new(bytes.Buffer)
+	saveConfig(o, resWriter, conf)
+	if got := resWriter.String(); got != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
 	}
 
-	if err := Parse("confy_test"); err == nil || err.Error() != "flags have been parsed already" {
-		t.Errorf("expected Parse() to fail with `flags already parsed` error, but got: %v", err)
+	// the rewritten file must be stable
+	conf, err = parseConfig(o, bytes.NewBufferString(want))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	resWriter = new(bytes.Buffer)
+	saveConfig(o, resWriter, conf)
+	if got := resWriter.String(); got != want {
+		t.Errorf("unstable result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
 	}
 
+	// comments of the user looking like usage comments are kept
+	flag.Int("workers", 100, "number of workers")
+	conf, err = parseConfig(o, bytes.NewBufferString(`
+# raised for prod (default 100)
+workers=8
+`))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	resWriter = new(bytes.Buffer)
+	saveConfig(o, resWriter, conf)
+	if got := resWriter.String(); !strings.Contains(got, "\n# raised for prod (default 100)\n# number of workers (int, default 100)\nworkers=8\n") {
+		t.Errorf("the comment of the user must be kept, got:\n%s", got)
+	}
+}
+
+func TestLeadingUserComment(t *testing.T) {
 	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
-	openOrCreate = func(n string, f int, p os.FileMode) (*os.File, error) {
-		return nil, fmt.Errorf("expected")
+	flag.Int("port", 0, "port")
+
+	// a comment directly above the first key is not the header
+	o := newOptions("confy_test", nil)
+	conf, err := parseConfig(o, bytes.NewBufferString("# my precious note\nport=1\n"))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	resWriter := new(bytes.Buffer)
+	if err := o.format.save(o, resWriter, conf); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if got := resWriter.String(); !strings.Contains(got, "\n# my precious note\n# port (int, default 0)\nport=1\n") {
+		t.Errorf("the comment of the user must be kept:\n%s", got)
 	}
 
-	if err := Parse("confy_test"); err == nil || !strings.HasSuffix(err.Error(), "expected") {
-		t.Errorf("expected Parse() to fail with `expected` error, but got: %v", err)
+	// while the generated header is dropped, even without the empty line
+	header := o.headerComment()
+	conf, err = parseConfig(o, bytes.NewBufferString(header+"\nport=1\n"))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	resWriter.Reset()
+	saveConfig(o, resWriter, conf)
+	if got := resWriter.String(); got != "\n# port (int, default 0)\nport=1\n" {
+		t.Errorf("the header must be dropped:\n%s", got)
+	}
+}
+
+func TestURLValues(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	endpoint := flag.String("endpoint", "", "key: url")
+	proxy := flag.String("proxy", "", "key=url")
+	filter := flag.String("filter", "", "key: value with = in a comment")
+
+	conf, err := parseConfig(newOptions("confy_test", nil), bytes.NewBufferString(`
+endpoint: http://example.com:8080
+proxy=http://proxy:3128
+filter: a:b # c=d`))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if len(conf.obsolete) != 0 {
+		t.Errorf("no obsolete keys expected, got: %v", conf.obsolete)
+	}
+	if *endpoint != "http://example.com:8080" {
+		t.Errorf("endpoint: (want: %q; got: %q)", "http://example.com:8080", *endpoint)
+	}
+	if *proxy != "http://proxy:3128" {
+		t.Errorf("proxy: (want: %q; got: %q)", "http://proxy:3128", *proxy)
+	}
+	if *filter != "a:b" {
+		t.Errorf("filter: (want: %q; got: %q)", "a:b", *filter)
+	}
+}
+
+func TestLineEndings(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	port := flag.Int("port", 0, "CRLF")
+	level := flag.String("log-level", "", "CRLF in continued line")
+	name := flag.String("name", "", "CR")
+
+	conf, err := parseConfig(newOptions("confy_test", nil), bytes.NewBufferString("port=8080\r\nlog-level=\"de\\\r\nbug\"\r\nname=a\rold=1\r"))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *port != 8080 {
+		t.Errorf("port: (want: %d; got: %d)", 8080, *port)
+	}
+	if *level != "debug" {
+		t.Errorf("log-level: (want: %q; got: %q)", "debug", *level)
+	}
+	if *name != "a" {
+		t.Errorf("name: (want: %q; got: %q)", "a", *name)
+	}
+	if len(conf.obsolete) != 1 || conf.obsolete["old"] != "1" {
+		t.Errorf("unexpected obsolete keys: %v", conf.obsolete)
+	}
+}
+
+func TestByteOrderMark(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	port := flag.Int("port", 0, "first key")
+	name := flag.String("name", "", "second key")
+
+	conf, err := parseConfig(newOptions("confy_test", nil), bytes.NewBufferString("\ufeffport=8080\nname=a\n"))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *port != 8080 || *name != "a" {
+		t.Errorf("unexpected values: %d, %q", *port, *name)
+	}
+	if len(conf.obsolete) != 0 {
+		t.Errorf("no obsolete keys expected, got: %v", conf.obsolete)
+	}
+}
+
+func TestOmitDefaults(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	port := flag.Int("port", 8080, "port")
+	flag.String("db.host", "localhost", "database host")
+
+	o := newOptions("confy_test", []Option{WithOmitDefaults(true)})
+	conf, err := parseConfig(o, bytes.NewBufferString(`
+# the proxy uses 8080
+# port (int, default 8080)
+# port=8080
+
+[db]
+
+# database host (string, default localhost)
+# host=localhost`))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	want := `
+# the proxy uses 8080
+# port (int, default 8080)
+# port=8080
+
+[db]
+
+# database host (string, default localhost)
+# host=localhost
+`
+	resWriter := new(bytes.Buffer)
+	saveConfig(o, resWriter, conf)
+	if got := resWriter.String(); got != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+	}
+
+	// uncommented and changed values are written as usual
+	if _, err := parseConfig(o, bytes.NewBufferString(strings.Replace(want, "# port=8080", "port=9090", 1))); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *port != 9090 {
+		t.Errorf("port: (want: %d; got: %d)", 9090, *port)
+	}
+	resWriter = new(bytes.Buffer)
+	saveConfig(o, resWriter, conf)
+	if !strings.Contains(resWriter.String(), "\n# port (int, default 8080)\nport=9090\n") {
+		t.Errorf("unexpected result:\n%s", resWriter.String())
+	}
+}
+
+func TestSecret(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	token := flag.String("api-token", "", "API token")
+	password := flag.String("password", "builtin", "password")
+	key := flag.String("key", "", "empty secret")
+
+	o := newOptions("confy_test", []Option{WithSecret("api-token", "password", "key")})
+	conf, err := parseConfig(o, bytes.NewBufferString(`api-token="s3cr3t" # personal`))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *token != "s3cr3t" || *password != "builtin" || *key != "" {
+		t.Errorf("unexpected values: %q, %q, %q", *token, *password, *key)
+	}
+
+	// live values must not leak into the file
+	*token, *password = "live", "live"
+	want := `
+# API token (string, default )
+api-token="s3cr3t" # personal
+
+# empty secret (string, default )
+key=
+
+# password (string, default ****)
+password=****
+`
+	resWriter := new(bytes.Buffer)
+	saveConfig(o, resWriter, conf)
+	if got := resWriter.String(); got != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+	}
+}
+
+func TestSaveConfig(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+
+	resWriter := new(bytes.Buffer)
+	obsKeys := make(map[string]string)
+	saveConfig(newOptions("confy_test", nil), resWriter, &config{obsolete: obsKeys})
+	got := resWriter.String()
+	if got != wantSavedEmpty {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", wantSavedEmpty, got)
+	}
+
+	resWriter = new(bytes.Buffer)
+	obsKeys["obs"] = "4"
+	saveConfig(newOptions("confy_test", nil), resWriter, &config{obsolete: obsKeys})
+	got = resWriter.String()
+	if got != wantSavedObs {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", wantSavedObs, got)
+	}
+
+	obsKeys["b"], obsKeys["a"], obsKeys["c"] = "2", "1", "3"
+	want := wantSavedObs[:len(wantSavedObs)-len("obs=4\n")] + "a=1\nb=2\nc=3\nobs=4\n"
+	for i := 0; i < 10; i++ {
+		resWriter = new(bytes.Buffer)
+		saveConfig(newOptions("confy_test", nil), resWriter, &config{obsolete: obsKeys})
+		if got = resWriter.String(); got != want {
+			t.Fatalf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+		}
+	}
+
+	resWriter = new(bytes.Buffer)
+	shorthand := flag.Int("shorthand", 3, "shorthand test")
+	flag.IntVar(shorthand, "s", 3, "shorthand test (shorthand)")
+	flag.IntVar(shorthand, "really-long-hand", 3, "shorthand test\n    \t(longhand)")
+	saveConfig(newOptions("confy_test", nil), resWriter, nil)
+	got = resWriter.String()
+	if got != wantSavedNil {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", wantSavedNil, got)
+	}
+}
+
+func TestParse(t *testing.T) {
+	// pipe stderr to a temporary file
+	oldErr := os.Stderr
+	var err error
+	if os.Stderr, err = ioutil.TempFile("", "confy_test_err"); err != nil {
+		t.Fatalf("failed to redirect stderr to tempfile")
+	}
+	defer func() {
+		os.Stderr = oldErr
+	}()
+	defer os.Remove(os.Stderr.Name())
+
+	// hide the test binary's own arguments from the command line parser
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	// keep the default config directory out of the real home directory
+	configHome, err := ioutil.TempDir("", "confy_test_config")
+	if err != nil {
+		t.Fatalf("failed to create temporary config directory")
+	}
+	defer os.RemoveAll(configHome)
+	oldConfigHome := os.Getenv("XDG_CONFIG_HOME")
+	os.Setenv("XDG_CONFIG_HOME", configHome)
+	defer os.Setenv("XDG_CONFIG_HOME", oldConfigHome)
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	oldFlag := flag.Int("old", 3, "old flag")
+	openOrCreate = func(n string, l int, p os.FileMode) (*os.File, error) {
+		f, err := ioutil.TempFile("", "confy_testinf0")
+		if err == nil {
+			tmpFileName = f.Name()
+		}
+		return f, err
+	}
+	if err := Parse("confy_test"); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	defer os.Remove(tmpFileName)
+
+	if *oldFlag != 3 {
+		t.Errorf("oldFlag: (want: %d; got: %d)", 3, *oldFlag)
+	}
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	newFlag := flag.Int("new", 3, "new flag")
+	os.Setenv("CONFY_TESTINF0", tmpFileName)
+	openOrCreate = os.OpenFile
+	if err := Parse("confy_test"); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+
+	if *newFlag != 3 {
+		t.Errorf("newFlag: (want: %d; got: %d)", 3, *newFlag)
+	}
+
+	if err := Parse("confy_test"); !errors.Is(err, ErrAlreadyParsed) || err.Error() != "flags have been parsed already" {
+		t.Errorf("expected Parse() to fail with `flags already parsed` error, but got: %v", err)
+	}
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	openOrCreate = func(n string, f int, p os.FileMode) (*os.File, error) {
+		return nil, fmt.Errorf("expected")
+	}
+	defer func() {
+		openOrCreate = os.OpenFile
+	}()
+
+	if err := Parse("confy_test"); err == nil || !strings.HasSuffix(err.Error(), "expected") {
+		t.Errorf("expected Parse() to fail with `expected` error, but got: %v", err)
+	}
+}
+
+func TestGetConfigPath(t *testing.T) {
+	configHome, err := ioutil.TempDir("", "confy_test_config")
+	if err != nil {
+		t.Fatalf("failed to create temporary config directory")
+	}
+	defer os.RemoveAll(configHome)
+	oldConfigHome := os.Getenv("XDG_CONFIG_HOME")
+	os.Setenv("XDG_CONFIG_HOME", configHome)
+	defer os.Setenv("XDG_CONFIG_HOME", oldConfigHome)
+
+	os.Setenv("CONFY_PATHINF0", "/some/where")
+	got, err := getConfigPath("Confy_Path", "CONFY_PATHINF0", ".ini")
+	if err != nil || got != "/some/where" {
+		t.Errorf("environment variable: (want: %s; got: %s, %v)", "/some/where", got, err)
+	}
+	os.Unsetenv("CONFY_PATHINF0")
+
+	home, err := ioutil.TempDir("", "confy_test_home")
+	if err != nil {
+		t.Fatalf("failed to create temporary home directory")
+	}
+	defer os.RemoveAll(home)
+	currentUser = func() (*user.User, error) {
+		return &user.User{HomeDir: home}, nil
+	}
+	defer func() {
+		currentUser = user.Current
+	}()
+
+	goos = "linux"
+	defer func() {
+		goos = runtime.GOOS
+	}()
+	want := filepath.Join(configHome, "confy_path", "config.ini")
+	got, err = getConfigPath("Confy_Path", "CONFY_PATHINF0", ".ini")
+	if err != nil || got != want {
+		t.Errorf("config dir: (want: %s; got: %s, %v)", want, got, err)
+	}
+	if _, err := os.Stat(filepath.Dir(want)); !os.IsNotExist(err) {
+		t.Errorf("config dir must only be created together with the config file: %v", err)
+	}
+
+	os.Setenv("XDG_CONFIG_HOME", "")
+	want = filepath.Join(home, ".config", "confy_path", "config.ini")
+	got, err = getConfigPath("Confy_Path", "CONFY_PATHINF0", ".ini")
+	if err != nil || got != want {
+		t.Errorf("config dir without XDG_CONFIG_HOME: (want: %s; got: %s, %v)", want, got, err)
+	}
+
+	goos = "windows"
+	appData := filepath.Join(home, "AppData", "Roaming")
+	os.Setenv("APPDATA", appData)
+	want = filepath.Join(appData, "confy_path", "config.ini")
+	got, err = getConfigPath("Confy_Path", "CONFY_PATHINF0", ".ini")
+	if err != nil || got != want {
+		t.Errorf("windows config dir: (want: %s; got: %s, %v)", want, got, err)
+	}
+	os.Unsetenv("APPDATA")
+	if _, err = getConfigPath("Confy_Path", "CONFY_PATHINF0", ".ini"); err == nil {
+		t.Errorf("expected an error on windows without APPDATA")
+	}
+
+	legacy := filepath.Join(home, ".confy_pathinf0")
+	if err := ioutil.WriteFile(legacy, nil, 0600); err != nil {
+		t.Fatalf("failed to create legacy config file")
+	}
+	got, err = getConfigPath("Confy_Path", "CONFY_PATHINF0", ".ini")
+	if err != nil || got != legacy {
+		t.Errorf("legacy config file: (want: %s; got: %s, %v)", legacy, got, err)
+	}
+
+	// packagers may override the default location
+	defaultPath := "/etc/confy_path/config"
+	DefaultPathFunc = func(appName string) (string, error) {
+		return defaultPath, nil
+	}
+	got, err = getConfigPath("Confy_Path", "CONFY_PATHINF0", ".ini")
+	if err != nil || got != defaultPath {
+		t.Errorf("default path func: (want: %s; got: %s, %v)", defaultPath, got, err)
+	}
+	defaultPath = ""
+	if got, err = getConfigPath("Confy_Path", "CONFY_PATHINF0", ".ini"); err != nil || got != legacy {
+		t.Errorf("empty default path: (want: %s; got: %s, %v)", legacy, got, err)
+	}
+	defaultPath = "/etc/confy_path/config"
+	os.Setenv("CONFY_PATHINF0", "/some/where")
+	if got, err = getConfigPath("Confy_Path", "CONFY_PATHINF0", ".ini"); err != nil || got != "/some/where" {
+		t.Errorf("environment variable over default path func: (want: %s; got: %s, %v)", "/some/where", got, err)
+	}
+	os.Unsetenv("CONFY_PATHINF0")
+	DefaultPathFunc = nil
+
+	// without the user database, the home directory is taken from $HOME
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		return
+	}
+	currentUser = func() (*user.User, error) {
+		return nil, user.UnknownUserIdError(os.Getuid())
+	}
+	oldHome := os.Getenv("HOME")
+	defer os.Setenv("HOME", oldHome)
+	os.Setenv("HOME", home)
+	got, err = getConfigPath("Confy_Path", "CONFY_PATHINF0", ".ini")
+	if err != nil || got != legacy {
+		t.Errorf("home from $HOME: (want: %s; got: %s, %v)", legacy, got, err)
+	}
+	os.Unsetenv("HOME")
+	_, err = getConfigPath("Confy_Path", "CONFY_PATHINF0", ".ini")
+	var userErr user.UnknownUserIdError
+	if !errors.As(err, &userErr) || !strings.Contains(err.Error(), "CONFY_PATHINF0") {
+		t.Errorf("expected the user error without $HOME, got: %v", err)
+	}
+}
+
+func TestConfigPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "confy_test_configpath")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "sub", "config")
+
+	os.Setenv("CONFY_CONFIGPATHINF0", cPath)
+	defer os.Unsetenv("CONFY_CONFIGPATHINF0")
+	if got, err := ConfigPath("confy_configpath"); err != nil || got != cPath {
+		t.Errorf("environment variable: (want: %s; got: %s, %v)", cPath, got, err)
+	}
+	if _, err := os.Stat(filepath.Dir(cPath)); !os.IsNotExist(err) {
+		t.Errorf("nothing must be created")
+	}
+	if got, err := ConfigPath("confy_configpath", WithPath("other")); err != nil || got != "other" {
+		t.Errorf("path option: (want: other; got: %s, %v)", got, err)
+	}
+	want := filepath.Join(dir, "config")
+	if got, err := ConfigPath("confy_configpath", WithEnvVarName("CONFY_CONFIGPATH_OTHER")); err != nil || got == cPath {
+		t.Errorf("custom environment variable must be honored: %s, %v", got, err)
+	}
+	os.Setenv("CONFY_CONFIGPATH_OTHER", want)
+	defer os.Unsetenv("CONFY_CONFIGPATH_OTHER")
+	if got, err := ConfigPath("confy_configpath", WithEnvVarName("CONFY_CONFIGPATH_OTHER")); err != nil || got != want {
+		t.Errorf("custom environment variable: (want: %s; got: %s, %v)", want, got, err)
+	}
+}
+
+func TestAppName(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_appname")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "config")
+
+	for _, appName := range []string{"", ".", "..", "my/app", `my\app`, "../app", "my app", "my\tapp", "my\napp"} {
+		if _, err := ConfigPath(appName); !errors.Is(err, ErrInvalidAppName) {
+			t.Errorf("%q: expected ErrInvalidAppName, got: %v", appName, err)
+		}
+		fs := flag.NewFlagSet("appname", flag.ContinueOnError)
+		if err := ParseWith(appName, WithPath(cPath), WithFlagSet(fs)); !errors.Is(err, ErrInvalidAppName) {
+			t.Errorf("%q: expected ErrInvalidAppName, got: %v", appName, err)
+		}
+	}
+	if _, err := os.Stat(cPath); !os.IsNotExist(err) {
+		t.Errorf("nothing must be written for invalid app names")
+	}
+
+	// the case of appName doesn't matter
+	os.Setenv("CONFY_APPNAME_PORT", "5")
+	defer os.Unsetenv("CONFY_APPNAME_PORT")
+	fs := flag.NewFlagSet("appname", flag.ContinueOnError)
+	port := fs.Int("port", 0, "port")
+	if err := ParseWith("Confy_AppName", WithPath(cPath), WithFlagSet(fs)); err != nil || *port != 5 {
+		t.Errorf("unexpected result: %d, %v", *port, err)
+	}
+	if goos == "linux" {
+		oldConfigHome := os.Getenv("XDG_CONFIG_HOME")
+		os.Setenv("XDG_CONFIG_HOME", dir)
+		defer os.Setenv("XDG_CONFIG_HOME", oldConfigHome)
+		want := filepath.Join(dir, "confy_appname", "config.ini")
+		if got, err := ConfigPath("Confy_AppName"); err != nil || got != want {
+			t.Errorf("unexpected path (want: %s; got: %s, %v)", want, got, err)
+		}
+	}
+}
+
+func TestParseSet(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = []string{os.Args[0], "-cmd=5"}
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	f, err := ioutil.TempFile("", "confy_testinf0")
+	if err != nil {
+		t.Fatalf("failed to create tempfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintln(f, "file=4")
+	f.Close()
+	os.Setenv("CONFY_SETINF0", f.Name())
+	defer os.Unsetenv("CONFY_SETINF0")
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	global := flag.Int("file", 3, "global flag")
+
+	fs := flag.NewFlagSet("set", flag.ContinueOnError)
+	file := fs.Int("file", 3, "file flag")
+	cmd := fs.Int("cmd", 3, "command line flag")
+	if err := ParseSet("confy_set", fs); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+
+	if *file != 4 {
+		t.Errorf("file: (want: %d; got: %d)", 4, *file)
+	}
+	if *cmd != 5 {
+		t.Errorf("cmd: (want: %d; got: %d)", 5, *cmd)
+	}
+	if *global != 3 || flag.Parsed() {
+		t.Errorf("ParseSet must not touch flag.CommandLine")
+	}
+	if !fs.Parsed() {
+		t.Errorf("ParseSet should parse the command line into the given set")
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	f, err := ioutil.TempFile("", "confy_testfile")
+	if err != nil {
+		t.Fatalf("failed to create tempfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintln(f, "file=4")
+	f.Close()
+	os.Setenv("CONFY_FILEINF0", f.Name()+".unused")
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	file := flag.Int("file", 3, "file flag")
+	if err := ParseFile("confy_file", f.Name()); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	os.Unsetenv("CONFY_FILEINF0")
+
+	if *file != 4 {
+		t.Errorf("file: (want: %d; got: %d)", 4, *file)
+	}
+	if _, err := os.Stat(f.Name() + ".unused"); !os.IsNotExist(err) {
+		t.Errorf("ParseFile must not use the default config path")
+	}
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil || !strings.HasPrefix(string(b), "# confy_file configuration") {
+		t.Errorf("config file was not rewritten with the confy_file header:\n%s", b)
+	}
+}
+
+func TestParseWith(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	f, err := ioutil.TempFile("", "confy_testwith")
+	if err != nil {
+		t.Fatalf("failed to create tempfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintln(f, "obs=4")
+	f.Close()
+
+	fs := flag.NewFlagSet("with", flag.ContinueOnError)
+	fs.Int("port", 3, "port flag")
+	warn := new(bytes.Buffer)
+	err = ParseWith("confy_with", WithPath(f.Name()), WithFlagSet(fs), WithWriter(warn), WithComment("see\nthe docs"))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+
+	if !strings.Contains(warn.String(), "WARNING") {
+		t.Errorf("update warning was not written to the writer: %q", warn.String())
+	}
+	b, _ := ioutil.ReadFile(f.Name())
+	if !strings.Contains(string(b), "\n#\n# see\n# the docs\n") {
+		t.Errorf("comment missing from config file:\n%s", b)
+	}
+	if !strings.Contains(string(b), "\nport=3\n") {
+		t.Errorf("flag set was not saved to config file:\n%s", b)
+	}
+}
+
+func TestEnvOverride(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = []string{os.Args[0], "-cmd=cmdline"}
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	f, err := ioutil.TempFile("", "confy_testenv")
+	if err != nil {
+		t.Fatalf("failed to create tempfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintln(f, "log-level=file\nfile=file\ncmd=file")
+	f.Close()
+
+	os.Setenv("CONFY_ENV_LOG_LEVEL", "env")
+	os.Setenv("CONFY_ENV_CMD", "env")
+	os.Setenv("OTHER_FILE", "other")
+	defer os.Unsetenv("CONFY_ENV_LOG_LEVEL")
+	defer os.Unsetenv("CONFY_ENV_CMD")
+	defer os.Unsetenv("OTHER_FILE")
+
+	fs := flag.NewFlagSet("env", flag.ContinueOnError)
+	level := fs.String("log-level", "default", "environment wins over file")
+	file := fs.String("file", "default", "file without environment")
+	cmd := fs.String("cmd", "default", "command line wins over environment")
+	if err := ParseWith("confy_env", WithPath(f.Name()), WithFlagSet(fs), WithUpdateWarning(false)); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *level != "env" || *file != "file" || *cmd != "cmdline" {
+		t.Errorf("unexpected precedence: (want: env, file, cmdline; got: %s, %s, %s)", *level, *file, *cmd)
+	}
+	if b, _ := ioutil.ReadFile(f.Name()); !strings.Contains(string(b), "\nlog-level=file\n") {
+		t.Errorf("environment value must not be persisted:\n%s", b)
+	}
+
+	os.Args = os.Args[:1]
+	fs = flag.NewFlagSet("env", flag.ContinueOnError)
+	file = fs.String("file", "default", "file with custom prefix")
+	if err := ParseWith("confy_env", WithPath(f.Name()), WithFlagSet(fs), WithEnvPrefix("OTHER_"), WithUpdateWarning(false)); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *file != "other" {
+		t.Errorf("custom prefix: (want: other; got: %s)", *file)
+	}
+}
+
+func TestAtomicRewrite(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_atomic")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(cPath, []byte("port=1\n"), 0640); err != nil {
+		t.Fatalf("failed to create config file")
+	}
+	os.Chmod(cPath, 0640)
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(cPath, link); err != nil {
+		t.Fatalf("failed to create symlink")
+	}
+
+	fs := flag.NewFlagSet("atomic", flag.ContinueOnError)
+	fs.Int("port", 0, "port")
+	if err := ParseWith("confy_atomic", WithPath(link), WithFlagSet(fs), WithFileMode(0644)); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+
+	if b, _ := ioutil.ReadFile(cPath); !strings.Contains(string(b), "# confy_atomic configuration") {
+		t.Errorf("config file was not rewritten:\n%s", b)
+	}
+	if fi, err := os.Stat(cPath); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("file mode was not preserved: %v", fi.Mode())
+	}
+	if fi, err := os.Lstat(link); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("symlink was replaced")
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_mode")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "config")
+
+	fs := flag.NewFlagSet("mode", flag.ContinueOnError)
+	fs.Int("port", 0, "port")
+	if err := ParseWith("confy_mode", WithPath(cPath), WithFlagSet(fs)); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if fi, err := os.Stat(cPath); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("fresh config file: (want: %v; got: %v)", os.FileMode(0600), fi.Mode().Perm())
+	}
+
+	os.Chmod(cPath, 0666)
+	warn := new(bytes.Buffer)
+	fs = flag.NewFlagSet("mode", flag.ContinueOnError)
+	fs.Int("port", 0, "port")
+	if err := ParseWith("confy_mode", WithPath(cPath), WithFlagSet(fs), WithWriter(warn), WithFileMode(0640)); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if !strings.Contains(warn.String(), "-rw-rw-rw-") {
+		t.Errorf("expected a warning about broad permissions, got: %q", warn.String())
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	for mode, insecure := range map[os.FileMode]bool{0644: false, 0620: true, 0602: true} {
+		os.Chmod(cPath, mode)
+		fs = flag.NewFlagSet("mode", flag.ContinueOnError)
+		fs.Int("port", 0, "port")
+		err := ParseWith("confy_mode", WithPath(cPath), WithFlagSet(fs), WithRejectInsecurePermissions(true))
+		if insecure && (!errors.Is(err, ErrInsecurePermissions) || !strings.Contains(err.Error(), cPath)) {
+			t.Errorf("%v: expected ErrInsecurePermissions, got: %v", mode, err)
+		} else if !insecure && err != nil {
+			t.Errorf("%v: unexpected error occurred: %v", mode, err)
+		}
+	}
+	// included files are checked as well
+	os.Chmod(cPath, 0600)
+	include := filepath.Join(filepath.Dir(cPath), "shared")
+	if err := ioutil.WriteFile(include, []byte("port=2\n"), 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", include, err)
+	}
+	os.Chmod(include, 0602)
+	if err := ioutil.WriteFile(cPath, []byte("include=shared\n"), 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", cPath, err)
+	}
+	fs = flag.NewFlagSet("mode", flag.ContinueOnError)
+	fs.Int("port", 0, "port")
+	err = ParseWith("confy_mode", WithPath(cPath), WithFlagSet(fs), WithRejectInsecurePermissions(true))
+	if !errors.Is(err, ErrInsecurePermissions) || !strings.Contains(err.Error(), include) {
+		t.Errorf("expected ErrInsecurePermissions for the include, got: %v", err)
+	}
+
+	for mode, insecure := range map[os.FileMode]bool{0600: false, 0640: true, 0604: true} {
+		os.Chmod(cPath, mode)
+		fs = flag.NewFlagSet("mode", flag.ContinueOnError)
+		fs.Int("port", 0, "port")
+		err := ParseWith("confy_mode", WithPath(cPath), WithFlagSet(fs), WithRejectReadableByOthers(true))
+		if insecure && (!errors.Is(err, ErrInsecurePermissions) || !strings.Contains(err.Error(), "grant read access")) {
+			t.Errorf("%v: expected ErrInsecurePermissions, got: %v", mode, err)
+		} else if !insecure && err != nil {
+			t.Errorf("%v: unexpected error occurred: %v", mode, err)
+		}
+	}
+}
+
+func TestBackup(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_backup")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(cPath, []byte("port=1\n"), 0600); err != nil {
+		t.Fatalf("failed to create config file")
+	}
+
+	for i := 0; i < 2; i++ {
+		fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+		fs.Int("port", 0, "port")
+		if err := ParseWith("confy_backup", WithPath(cPath), WithFlagSet(fs), WithBackup(true)); err != nil {
+			t.Fatalf("unexpected error occurred: %v", err)
+		}
+		// the second run doesn't change the file and must keep the backup
+		if b, err := ioutil.ReadFile(cPath + ".bak"); err != nil || string(b) != "port=1\n" {
+			t.Errorf("run %d: unexpected backup content: %q, %v", i, b, err)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = []string{os.Args[0], "-port=3"}
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_dryrun")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "config")
+
+	var content []byte
+	fs := flag.NewFlagSet("dryrun", flag.ContinueOnError)
+	port := fs.Int("port", 0, "port")
+	err = ParseWith("confy_dryrun", WithPath(cPath), WithFlagSet(fs), WithDryRun(func(b []byte) {
+		content = b
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if _, err := os.Stat(cPath); !os.IsNotExist(err) {
+		t.Errorf("dry run must not create the config file")
+	}
+	if !strings.Contains(string(content), "\nport=0\n") {
+		t.Errorf("unexpected dry run content:\n%s", content)
+	}
+	if *port != 3 {
+		t.Errorf("command line must still be parsed: (want: 3; got: %d)", *port)
+	}
+}
+
+func TestParseReadOnly(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_readonly")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "config")
+	os.Setenv("CONFY_READONLYINF0", cPath)
+	defer os.Unsetenv("CONFY_READONLYINF0")
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	port := flag.Int("port", 3, "port")
+	if err := ParseReadOnly("confy_readonly"); err != nil {
+		t.Fatalf("a missing file should not be an error: %v", err)
+	}
+	if _, err := os.Stat(cPath); !os.IsNotExist(err) || *port != 3 {
+		t.Errorf("a missing file must not be created")
+	}
+
+	if err := ioutil.WriteFile(cPath, []byte("port=4\n"), 0400); err != nil {
+		t.Fatalf("failed to create config file")
+	}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	port = flag.Int("port", 3, "port")
+	if err := ParseReadOnly("confy_readonly"); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(cPath); *port != 4 || string(b) != "port=4\n" {
+		t.Errorf("read-only file: (want: 4, unchanged; got: %d, %q)", *port, b)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_errors")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+
+	// a directory cannot be opened as config file
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	if err := ParseWith("confy_test", WithPath(dir)); !errors.Is(err, ErrOpen) {
+		t.Errorf("expected ErrOpen, got: %v", err)
+	}
+
+	// the cause stays accessible, e.g. files which are not permitted to open
+	openOrCreate = func(name string, f int, perm os.FileMode) (*os.File, error) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	err = ParseWith("confy_test", WithPath(filepath.Join(dir, "denied")))
+	openOrCreate = os.OpenFile
+	var pathErr *os.PathError
+	if !errors.Is(err, os.ErrPermission) || !errors.Is(err, ErrOpen) || !errors.As(err, &pathErr) {
+		t.Errorf("expected a permission error, got: %v", err)
+	}
+
+	// a non-empty directory cannot be replaced by the backup
+	cPath := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(cPath, []byte("port=4\n"), 0600); err != nil {
+		t.Fatalf("failed to create config file")
+	}
+	if err := os.MkdirAll(filepath.Join(cPath+".bak", "keep"), 0700); err != nil {
+		t.Fatalf("failed to create directory")
+	}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flag.Int("port", 3, "port")
+	err = ParseWith("confy_test", WithPath(cPath), WithBackup(true))
+	if !errors.Is(err, ErrWrite) || errors.Is(err, ErrOpen) {
+		t.Errorf("expected ErrWrite, got: %v", err)
+	}
+
+	flag.CommandLine.Parse(nil)
+	if err := ParseWith("confy_test", WithPath(cPath)); !errors.Is(err, ErrAlreadyParsed) {
+		t.Errorf("expected ErrAlreadyParsed, got: %v", err)
+	}
+}
+
+func TestParseDetailed(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_detailed")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(cPath, []byte("port=1\nobs=4\n"), 0600); err != nil {
+		t.Fatalf("failed to create config file")
+	}
+
+	for i, wantChanged := range []bool{true, false} {
+		fs := flag.NewFlagSet("detailed", flag.ContinueOnError)
+		fs.Int("port", 0, "port")
+		res, err := ParseDetailed("confy_detailed", WithPath(cPath), WithFlagSet(fs), WithWriter(ioutil.Discard))
+		if err != nil {
+			t.Fatalf("unexpected error occurred: %v", err)
+		}
+		if res.Path != cPath || res.Changed != wantChanged || len(res.ObsoleteKeys) != 1 || res.ObsoleteKeys["obs"] != "4" || res.FirstRun {
+			t.Errorf("run %d: unexpected result: %+v", i, res)
+		}
+	}
+
+	// fresh files are reported as first run, once
+	cPath = filepath.Join(dir, "fresh")
+	for i, wantFirstRun := range []bool{true, false} {
+		fs := flag.NewFlagSet("detailed", flag.ContinueOnError)
+		fs.Int("port", 0, "port")
+		res, err := ParseDetailed("confy_detailed", WithPath(cPath), WithFlagSet(fs))
+		if err != nil {
+			t.Fatalf("unexpected error occurred: %v", err)
+		}
+		if res.FirstRun != wantFirstRun || res.Changed != wantFirstRun {
+			t.Errorf("fresh run %d: unexpected result: %+v", i, res)
+		}
+	}
+}
+
+func TestSetFlags(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = []string{os.Args[0], "-debug"}
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_setflags")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(cPath, []byte("port=1\n# limit=3\nobs=4\n\n[db]\nname=app\n"), 0600); err != nil {
+		t.Fatalf("failed to create config file")
+	}
+
+	// suggestions, obsolete keys, defaults and the command line don't count
+	fs := flag.NewFlagSet("setflags", flag.ContinueOnError)
+	fs.Int("port", 0, "port")
+	fs.Int("limit", 0, "limit")
+	fs.Bool("debug", false, "debug")
+	fs.String("db.name", "", "database name")
+	fs.String("db.user", "", "database user")
+	res, err := ParseDetailed("confy_setflags", WithPath(cPath), WithFlagSet(fs), WithWriter(ioutil.Discard))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if want := "[db.name port]"; fmt.Sprint(res.SetFlags) != want {
+		t.Errorf("unexpected flags set from the file (want: %s; got: %v)", want, res.SetFlags)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	f, err := ioutil.TempFile("", "confy_testlogger")
+	if err != nil {
+		t.Fatalf("failed to create tempfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintln(f, "obs=4")
+	f.Close()
+
+	buf := new(bytes.Buffer)
+	l := log.New(buf, "confy: ", 0)
+	fs := flag.NewFlagSet("logger", flag.ContinueOnError)
+	if err := ParseWith("confy_logger", WithPath(f.Name()), WithFlagSet(fs), WithLogger(l)); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), "confy: !!!!!!!!!!\n! WARNING") {
+		t.Errorf("update warning was not logged: %q", buf.String())
+	}
+
+	buf.Reset()
+	fs = flag.NewFlagSet("logger", flag.ContinueOnError)
+	if err := ParseWith("confy_logger", WithPath(f.Name()), WithFlagSet(fs), WithLogger(l), WithUpdateWarning(false)); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("update warning should be disabled: %q", buf.String())
+	}
+	if b, _ := ioutil.ReadFile(f.Name()); !strings.HasSuffix(string(b), "\nobs=4\n") {
+		t.Errorf("obsolete key must be preserved:\n%s", b)
+	}
+}
+
+func TestParseFiles(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_testfiles")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	system, user := filepath.Join(dir, "system"), filepath.Join(dir, "user")
+	if err := ioutil.WriteFile(system, []byte("host=system\nport=1\nsysold=1\n"), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", system, err)
+	}
+	if err := ioutil.WriteFile(user, []byte("port=2\nuserold=2\n"), 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", user, err)
+	}
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	host := flag.String("host", "", "host")
+	port := flag.Int("port", 0, "port")
+	name := flag.String("name", "", "name")
+	// like ParseFiles, but without the update warning
+	parseFiles := func(paths ...string) error {
+		return ParseWith("confy_files", WithPath(paths[len(paths)-1]), WithUpdateWarning(false), func(o *options) {
+			o.baseFiles = paths[:len(paths)-1]
+		})
+	}
+	if err := parseFiles(system, filepath.Join(dir, "missing"), user); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *host != "system" || *port != 2 || *name != "" {
+		t.Errorf("unexpected values: %q, %d, %q", *host, *port, *name)
+	}
+
+	b, err := ioutil.ReadFile(user)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", user, err)
+	}
+	for _, line := range []string{"\n# host=system\n", "\nport=2\n", "\nname=\n", "\nsysold=1\nuserold=2\n"} {
+		if !strings.Contains(string(b), line) {
+			t.Errorf("missing %q in:\n%s", line, b)
+		}
+	}
+	if b, err := ioutil.ReadFile(system); err != nil || string(b) != "host=system\nport=1\nsysold=1\n" {
+		t.Errorf("the base file must not be written:\n%s", b)
+	}
+
+	// the user file keeps not overriding the base file
+	if err := ioutil.WriteFile(system, []byte("host=changed\n"), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", system, err)
+	}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	host = flag.String("host", "", "host")
+	flag.Int("port", 0, "port")
+	flag.String("name", "", "name")
+	if err := parseFiles(system, user); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *host != "changed" {
+		t.Errorf("host: (want: %q; got: %q)", "changed", *host)
+	}
+}
+
+func TestUnsetMarker(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_testunset")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	system, user := filepath.Join(dir, "system"), filepath.Join(dir, "user")
+	if err := ioutil.WriteFile(system, []byte("host=system\nport=1\nname=system\n"), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", system, err)
+	}
+	if err := ioutil.WriteFile(user, []byte("host=!unset\nport=!unset # default\nname=\"!unset\"\n"), 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", user, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		host := flag.String("host", "localhost", "host")
+		port := flag.Int("port", 80, "port")
+		name := flag.String("name", "", "name")
+		if err := ParseFiles("confy_unset", system, user); err != nil {
+			t.Fatalf("unexpected error occurred: %v", err)
+		}
+		if *host != "localhost" || *port != 80 || *name != "!unset" {
+			t.Errorf("run %d: unexpected values: %q, %d, %q", i, *host, *port, *name)
+		}
+	}
+	b, err := ioutil.ReadFile(user)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", user, err)
+	}
+	for _, line := range []string{"\nhost=!unset\n", "\nport=!unset # default\n", "\nname=\"!unset\"\n", "A VALUE of !unset resets"} {
+		if !strings.Contains(string(b), line) {
+			t.Errorf("missing %q in:\n%s", line, b)
+		}
+	}
+
+	// the marker can be changed or disabled
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	host := flag.String("host", "localhost", "host")
+	port := flag.Int("port", 80, "port")
+	if err := ParseWith("confy_unset", WithPath(user), WithUnsetMarker("<default>"), WithReadOnly(true)); err == nil {
+		t.Errorf("expected an error for the invalid port, got: %q, %d", *host, *port)
+	}
+	if err := ioutil.WriteFile(user, []byte("host=!unset\nport=<default>\n"), 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", user, err)
+	}
+	*port = 1
+	if err := ParseWith("confy_unset", WithPath(user), WithUnsetMarker("<default>"), WithReadOnly(true)); err != nil || *host != "!unset" || *port != 80 {
+		t.Errorf("unexpected result: %q, %d, %v", *host, *port, err)
+	}
+
+	// values equal to the marker are written quoted
+	os.Remove(user)
+	for i := 0; i < 2; i++ {
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		name := flag.String("name", "default", "name")
+		if err := ApplyAndPersist("confy_unset", map[string]string{"name": "!unset"}, WithPath(user)); err != nil || *name != "!unset" {
+			t.Errorf("run %d: unexpected result: %q, %v", i, *name, err)
+		}
+	}
+	if b, _ := ioutil.ReadFile(user); !strings.Contains(string(b), "\nname=\"!unset\"\n") {
+		t.Errorf("the value must be quoted:\n%s", b)
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "confy_testinclude")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	for name, content := range map[string]string{
+		"sub/common": "host=common\nport=1\nsubold=1\ninclude=nested",
+		"sub/nested": "name=nested\nport=2",
+		"sub/loop":   "include=../main",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	host := flag.String("host", "", "host")
+	port := flag.Int("port", 0, "port")
+	name := flag.String("name", "", "name")
+	o := newOptions("confy_test", []Option{WithPath(filepath.Join(dir, "main"))})
+	conf, err := parseConfig(o, bytes.NewBufferString(`port=3
+# shared settings
+include = sub/common # inline
+name=main`))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *host != "common" || *port != 3 || *name != "main" {
+		t.Errorf("unexpected values: %q, %d, %q", *host, *port, *name)
+	}
+	if len(conf.obsolete) != 0 {
+		t.Errorf("obsolete keys of included files must be discarded: %v", conf.obsolete)
+	}
+
+	// includes stay where they were written
+	want := `
+# port (int, default 0)
+port=3
+
+# shared settings
+include=sub/common # inline
+
+# name (string, default )
+name=main
+
+# host (string, default )
+# host=common
+`
+	resWriter := new(bytes.Buffer)
+	saveConfig(o, resWriter, conf)
+	if got := resWriter.String(); got != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+	}
+	if conf, err = parseConfig(o, bytes.NewBufferString(want)); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	resWriter.Reset()
+	saveConfig(o, resWriter, conf)
+	if got := resWriter.String(); got != want {
+		t.Errorf("unstable result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+	}
+
+	_, err = parseConfig(o, bytes.NewBufferString("include=sub/loop"))
+	if err == nil || !strings.Contains(err.Error(), "includes itself") {
+		t.Errorf("expected an include cycle error, got: %v", err)
+	}
+	_, err = parseConfig(o, bytes.NewBufferString("include=sub/missing"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 1: unable to include") {
+		t.Errorf("expected an error for a missing include, got: %v", err)
+	}
+}
+
+func TestConcurrentParse(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	f, err := ioutil.TempFile("", "confy_testconcurrent")
+	if err != nil {
+		t.Fatalf("failed to create tempfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintln(f, "port=8080")
+	f.Close()
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	port := fs.Int("port", 0, "port")
+	errs := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func() {
+			errs <- ParseWith("confy_concurrent", WithFlagSet(fs), WithPath(f.Name()))
+		}()
+	}
+	succeeded := 0
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err == nil {
+			succeeded++
+		} else if err.Error() != "flags have been parsed already" {
+			t.Errorf("unexpected error occurred: %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("exactly one Parse call should succeed, got %d", succeeded)
+	}
+	if *port != 8080 {
+		t.Errorf("port: (want: %d; got: %d)", 8080, *port)
+	}
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil || !strings.HasPrefix(string(b), "# confy_concurrent configuration") || !strings.HasSuffix(string(b), "\nport=8080\n") {
+		t.Errorf("config file was corrupted:\n%s", b)
+	}
+}
+
+func TestWriteDefaultConfig(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	port := flag.Int("port", 8080, "port")
+	flag.IntVar(port, "p", 8080, "port (shorthand)")
+	flag.String("db.host", "localhost", "database host")
+	flag.Int("other", 8080, "same default")
+	*port = 9090
+
+	resWriter := new(bytes.Buffer)
+	if err := WriteDefaultConfig("confy_test", resWriter); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	got := resWriter.String()
+	if !strings.HasPrefix(got, "# confy_test configuration\n") {
+		t.Errorf("header missing:\n%s", got)
+	}
+	want := `
+# same default (int, default 8080)
+other=8080
+
+# port (int, default 8080)
+port=8080
+
+[db]
+
+# database host (string, default localhost)
+host=localhost
+`
+	if !strings.HasSuffix(got, want) {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+	}
+	if *port != 9090 || flag.Parsed() {
+		t.Errorf("the flags must not be modified")
+	}
+}
+
+func TestDumpConfig(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flag.Int("port", 8080, "port")
+	flag.String("token", "", "token")
+	if err := flag.CommandLine.Parse([]string{"-port=9090", "-token=s3cr3t"}); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+
+	resWriter := new(bytes.Buffer)
+	if err := DumpConfig(resWriter, WithSecret("token")); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	want := `
+# port (int, default 8080)
+port=9090
+
+# token (string, default )
+token=****
+`
+	if got := resWriter.String(); got != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+	}
+
+	f, err := ioutil.TempFile("", "confy_testdump")
+	if err != nil {
+		t.Fatalf("failed to create tempfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+	if err := DumpConfig(f); err == nil {
+		t.Errorf("expected an error writing to a closed file")
+	}
+}
+
+func TestHeader(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flag.Int("port", 8080, "port")
+	flag.String("name", "", "name")
+
+	for _, test := range []struct {
+		opts []Option
+		want string
+	}{
+		{[]Option{WithHeader("My App\n\n# see https://example.com\n")}, "# My App\n#\n# see https://example.com\n\n# name"},
+		{[]Option{WithHeader("")}, "\n# name"},
+		{[]Option{WithHeader(""), WithComment("comment")}, "# comment\n\n# name"},
+		{[]Option{WithCommentPrefix(";"), WithHeader("; My App\nline")}, "; My App\n; line\n\n; name"},
+	} {
+		o := newOptions("confy_test", test.opts)
+		resWriter := new(bytes.Buffer)
+		if err := o.format.save(o, resWriter, nil); err != nil {
+			t.Fatalf("unexpected error occurred: %v", err)
+		}
+		if got := resWriter.String(); !strings.HasPrefix(got, test.want) {
+			t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", test.want, got)
+		}
+
+		// the header is not preserved as user comment
+		conf, err := parseConfig(o, bytes.NewBufferString(resWriter.String()))
+		if err != nil {
+			t.Fatalf("unexpected error occurred: %v", err)
+		}
+		rewritten := new(bytes.Buffer)
+		o.format.save(o, rewritten, conf)
+		if rewritten.String() != resWriter.String() {
+			t.Errorf("unstable result:\nWANT:\n%s\n\nGOT:\n%s\n", resWriter, rewritten)
+		}
+	}
+}
+
+func TestUpdateWarningText(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	f, err := ioutil.TempFile("", "confy_testwarning")
+	if err != nil {
+		t.Fatalf("failed to create tempfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintln(f, "obs=1")
+	f.Close()
+	os.Setenv("CONFY_WARNING_CONFIG", f.Name())
+	defer os.Unsetenv("CONFY_WARNING_CONFIG")
+
+	for text, want := range map[string]string{
+		"check %[2]s of %[1]s, 100%%\n": "check " + f.Name() + " of confy_warning, 100%\n",
+		"obsolete keys\n":               "obsolete keys\n",
+	} {
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		logged := new(bytes.Buffer)
+		res, err := ParseDetailed("confy_warning", WithEnvVarName("CONFY_WARNING_CONFIG"), WithUpdateWarningText(text), WithWriter(logged))
+		if err != nil {
+			t.Fatalf("unexpected error occurred: %v", err)
+		}
+		if res.Path != f.Name() {
+			t.Errorf("path: (want: %s; got: %s)", f.Name(), res.Path)
+		}
+		if logged.String() != want {
+			t.Errorf("warning: (want: %q; got: %q)", want, logged.String())
+		}
+	}
+}
+
+func TestRequired(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = []string{os.Args[0], "-endpoint=https://example.com"}
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	f, err := ioutil.TempFile("", "confy_testrequired")
+	if err != nil {
+		t.Fatalf("failed to create tempfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintln(f, "name=file")
+	f.Close()
+
+	newFlags := func() {
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		flag.String("api-key", "", "api key")
+		flag.String("endpoint", "", "endpoint")
+		flag.String("name", "", "name")
+		flag.Int("port", 80, "port")
+	}
+	newFlags()
+	err = ParseWith("confy_required", WithPath(f.Name()), WithRequired("api-key", "endpoint", "name"), WithRequired("port"))
+	if !errors.Is(err, ErrRequired) || err.Error() != "missing required flags api-key, port" {
+		t.Errorf("expected the missing flags api-key and port, got: %v", err)
+	}
+
+	newFlags()
+	os.Setenv("CONFY_REQUIRED_API_KEY", "key")
+	defer os.Unsetenv("CONFY_REQUIRED_API_KEY")
+	if err := ParseWith("confy_required", WithPath(f.Name()), WithRequired("api-key", "endpoint", "name")); err != nil {
+		t.Errorf("unexpected error occurred: %v", err)
+	}
+}
+
+func TestValidator(t *testing.T) {
+	oldArgs := os.Args
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	f, err := ioutil.TempFile("", "confy_testvalidator")
+	if err != nil {
+		t.Fatalf("failed to create tempfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintln(f, "port=0")
+	f.Close()
+
+	var calls []string
+	port := func(value string) error {
+		calls = append(calls, value)
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 65535 {
+			return errors.New("must be between 1 and 65535")
+		}
+		return nil
+	}
+	parse := func(args ...string) error {
+		os.Args = append([]string{oldArgs[0]}, args...)
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		flag.Int("port", 80, "port")
+		return ParseWith("confy_validator", WithPath(f.Name()), WithValidator("port", port), WithValidator("missing", port))
+	}
+
+	if err := parse(); err == nil || err.Error() != `invalid value "0" for flag port: must be between 1 and 65535` {
+		t.Errorf("expected the value from the file to be rejected, got: %v", err)
+	}
+
+	os.Setenv("CONFY_VALIDATOR_PORT", "70000")
+	if err := parse(); err == nil || !strings.Contains(err.Error(), `"70000"`) {
+		t.Errorf("expected the value from the environment to be rejected, got: %v", err)
+	}
+	os.Unsetenv("CONFY_VALIDATOR_PORT")
+
+	if err := parse("-port=-1"); err == nil || !strings.Contains(err.Error(), `"-1"`) {
+		t.Errorf("expected the value from the command line to be rejected, got: %v", err)
+	}
+
+	calls = nil
+	if err := parse("-port=8080"); err != nil {
+		t.Errorf("unexpected error occurred: %v", err)
+	}
+	if strings.Join(calls, ",") != "8080" {
+		t.Errorf("expected the validator to be called once with the final value, got: %q", calls)
+	}
+}
+
+func TestAfterLoad(t *testing.T) {
+	oldArgs := os.Args
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	f, err := ioutil.TempFile("", "confy_testafterload")
+	if err != nil {
+		t.Fatalf("failed to create tempfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintln(f, "port=1")
+	f.Close()
+
+	var calls []string
+	hook := func(fs *flag.FlagSet) error {
+		calls = append(calls, fs.Lookup("port").Value.String())
+		return nil
+	}
+	failing := func(fs *flag.FlagSet) error {
+		calls = append(calls, "failing")
+		return errors.New("cross check failed")
+	}
+	parse := func(opts ...Option) error {
+		os.Args = []string{oldArgs[0], "-port=8080"}
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		flag.Int("port", 80, "port")
+		return ParseWith("confy_afterload", append([]Option{WithPath(f.Name())}, opts...)...)
+	}
+
+	// the hooks see the final values, once
+	if err := parse(WithAfterLoad(hook), WithAfterLoad(hook)); err != nil {
+		t.Errorf("unexpected error occurred: %v", err)
+	}
+	if strings.Join(calls, ",") != "8080,8080" {
+		t.Errorf("expected each hook to be called once with the final value, got: %q", calls)
+	}
+
+	calls = nil
+	if err := parse(WithAfterLoad(failing), WithAfterLoad(hook)); err == nil || err.Error() != "cross check failed" {
+		t.Errorf("expected the error of the hook, got: %v", err)
+	}
+	if strings.Join(calls, ",") != "failing" {
+		t.Errorf("expected the hooks to stop at the failing one, got: %q", calls)
+	}
+
+	// invalid flags are reported without calling the hooks
+	calls = nil
+	invalid := WithValidator("port", func(string) error { return errors.New("invalid") })
+	if err := parse(invalid, WithAfterLoad(hook)); err == nil || len(calls) > 0 {
+		t.Errorf("unexpected result: %q, %v", calls, err)
+	}
+}
+
+// listValue collects repeated flags like -tag=a -tag=b.
+type listValue []string
+
+func (l *listValue) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func (l *listValue) Get() interface{} {
+	return []string(*l)
+}
+
+func TestList(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	var tags, paths listValue
+	flag.Var(&tags, "tag", "tags")
+	flag.Var(&paths, "path", "paths")
+	flag.String("name", "", "name")
+
+	o := newOptions("confy_test", []Option{WithList("", "tag"), WithList(":", "path")})
+	in := `
+# name (string, default )
+name=x,y
+
+# paths (default )
+path=/usr/bin:"/opt/my:app"
+
+# tags (default )
+tag="a,b", c ,, '$HOME' # comment
+`
+	conf, err := parseConfig(o, bytes.NewBufferString(in))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if want := []string{"a,b", "c", "$HOME"}; strings.Join(tags, "|") != strings.Join(want, "|") {
+		t.Errorf("tag: (want: %q; got: %q)", want, tags)
+	}
+	if want := []string{"/usr/bin", "/opt/my:app"}; strings.Join(paths, "|") != strings.Join(want, "|") {
+		t.Errorf("path: (want: %q; got: %q)", want, paths)
+	}
+	if name := flag.Lookup("name").Value.String(); name != "x,y" {
+		t.Errorf("name: (want: %q; got: %q)", "x,y", name)
+	}
+
+	// unchanged values are written as they were, changed ones are joined
+	resWriter := new(bytes.Buffer)
+	saveConfig(o, resWriter, conf)
+	if got := resWriter.String(); got != in {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", in, got)
+	}
+	tags = append(tags, "d e", "")
+	resWriter = new(bytes.Buffer)
+	saveConfig(o, resWriter, conf)
+	if want := "\ntag=\"a,b\",c,$$HOME,d e,\"\" # comment\n"; !strings.Contains(resWriter.String(), want) {
+		t.Errorf("expected %q in:\n%s", want, resWriter.String())
+	}
+
+	// joined values are read back the same
+	tags = nil
+	if _, err := parseConfig(o, bytes.NewBufferString(resWriter.String())); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if want := []string{"a,b", "c", "$HOME", "d e", ""}; strings.Join(tags, "|") != strings.Join(want, "|") {
+		t.Errorf("tag: (want: %q; got: %q)", want, tags)
+	}
+}
+
+func TestDuration(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	timeout := flag.Duration("timeout", 90*time.Minute, "timeout")
+	interval := flag.Duration("interval", time.Second, "interval")
+	retry := flag.Duration("retry", 0, "retry")
+
+	o := newOptions("confy_test", nil)
+	conf, err := parseConfig(o, bytes.NewBufferString(`
+# interval (duration, default 1s)
+interval=1.5h
+
+# retry (duration, default 0s)
+retry=2m 30s
+`))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *interval != 90*time.Minute || *retry != 150*time.Second {
+		t.Errorf("unexpected durations: interval=%v retry=%v", *interval, *retry)
+	}
+
+	want := `
+# interval (duration, default 1s)
+interval=1.5h
+
+# retry (duration, default 0s)
+retry=2m 30s
+
+# timeout (duration, default 1h30m)
+timeout=1h30m
+`
+	resWriter := new(bytes.Buffer)
+	saveConfig(o, resWriter, conf)
+	if got := resWriter.String(); got != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+	}
+
+	// changed durations are written normalized and read back the same
+	*interval, *retry = 2*time.Hour, 0
+	resWriter = new(bytes.Buffer)
+	saveConfig(o, resWriter, conf)
+	if got := resWriter.String(); !strings.Contains(got, "\ninterval=2h\n") || !strings.Contains(got, "\nretry=0s\n") {
+		t.Errorf("unexpected result:\n%s", got)
+	}
+	if _, err := parseConfig(o, bytes.NewBufferString(resWriter.String())); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *timeout != 90*time.Minute || *interval != 2*time.Hour || *retry != 0 {
+		t.Errorf("unexpected durations: timeout=%v interval=%v retry=%v", *timeout, *interval, *retry)
+	}
+}
+
+func TestBareBool(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	debug := flag.Bool("debug", false, "debug")
+	verbose := flag.Bool("log.verbose", false, "verbose")
+	name := flag.String("name", "", "name")
+
+	conf, err := parseConfig(newOptions("confy_test", nil), bytes.NewBufferString(`
+DEBUG # enabled for now
+name
+[log]
+verbose`))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if !*debug || !*verbose {
+		t.Errorf("expected bare boolean keys to be true, got debug=%v log.verbose=%v", *debug, *verbose)
+	}
+	if *name != "" || len(conf.obsolete) > 0 {
+		t.Errorf("expected bare non-boolean keys to be ignored, got name=%q obsolete=%v", *name, conf.obsolete)
+	}
+	if got := conf.comments["debug"].inline; got != "# enabled for now" {
+		t.Errorf("inline comment: (want: %q; got: %q)", "# enabled for now", got)
+	}
+}
+
+func TestBoolWords(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	debug := flag.Bool("debug", false, "debug")
+	name := flag.String("name", "", "name")
+
+	for val, want := range map[string]bool{
+		"yes": true, "On": true, "ENABLED": true, "true": true, "1": true,
+		"no": false, "off": false, "Disabled": false, "false": false, "0": false,
+	} {
+		*debug = !want
+		conf, err := parseConfig(newOptions("confy_test", nil), bytes.NewBufferString("debug="+val))
+		if err != nil {
+			t.Errorf("%s: unexpected error occurred: %v", val, err)
+			continue
+		}
+		if *debug != want {
+			t.Errorf("%s: (want: %v; got: %v)", val, want, *debug)
+		}
+		// the value is preserved as written
+		resWriter := new(bytes.Buffer)
+		saveConfig(newOptions("confy_test", nil), resWriter, conf)
+		if !strings.Contains(resWriter.String(), "\ndebug="+val+"\n") {
+			t.Errorf("%s: unexpected result:\n%s", val, resWriter.String())
+		}
+	}
+
+	// other flags are not affected
+	if _, err := parseConfig(newOptions("confy_test", nil), bytes.NewBufferString("name=yes")); err != nil || *name != "yes" {
+		t.Errorf("name: (want: %q; got: %q, %v)", "yes", *name, err)
+	}
+	if _, err := parseConfig(newOptions("confy_test", nil), bytes.NewBufferString("debug=maybe")); err == nil {
+		t.Errorf("expected an error for debug=maybe")
+	}
+}
+
+func TestParseContext(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_context")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "config")
+	os.Setenv("CONFY_CONTEXTINF0", cPath)
+	defer os.Unsetenv("CONFY_CONTEXTINF0")
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flag.Int("port", 3, "port")
+	ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	if err := ParseContext(ctx, "confy_context"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to be exceeded, got: %v", err)
+	}
+	if _, err := os.Stat(cPath); !os.IsNotExist(err) {
+		t.Errorf("the config file must not be created once ctx is done")
+	}
+
+	// reading is given up once ctx is done
+	ctx, cancel = context.WithCancel(context.Background())
+	r := ctxReader{ctx, strings.NewReader("port=4")}
+	cancel()
+	if _, err := parseConfig(newOptions("confy_context", nil), r); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected reading to be canceled, got: %v", err)
+	}
+
+	if err := ParseContext(context.Background(), "confy_context"); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if content, err := ioutil.ReadFile(cPath); err != nil || !strings.Contains(string(content), "\nport=3\n") {
+		t.Errorf("unexpected config file: %q, %v", content, err)
+	}
+}
+
+func TestDiffSink(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_diffsink")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(cPath, []byte("port=1\n"), 0600); err != nil {
+		t.Fatalf("failed to create config file")
+	}
+
+	for i := 0; i < 2; i++ {
+		var calls int
+		var oldContent, newContent []byte
+		fs := flag.NewFlagSet("diffsink", flag.ContinueOnError)
+		fs.Int("port", 0, "port")
+		err := ParseWith("confy_diffsink", WithPath(cPath), WithFlagSet(fs), WithDiffSink(func(o, n []byte) {
+			calls++
+			oldContent, newContent = o, n
+			// the file is not written yet
+			if b, err := ioutil.ReadFile(cPath); err != nil || string(b) != "port=1\n" {
+				t.Errorf("unexpected config file before writing: %q, %v", b, err)
+			}
+		}))
+		if err != nil {
+			t.Fatalf("unexpected error occurred: %v", err)
+		}
+		// the second run doesn't change the file
+		if i == 1 {
+			if calls != 0 {
+				t.Errorf("run %d: fn must not be called for an unchanged file", i)
+			}
+			continue
+		}
+		b, err := ioutil.ReadFile(cPath)
+		if err != nil {
+			t.Fatalf("failed to read config file: %v", err)
+		}
+		if calls != 1 || string(oldContent) != "port=1\n" || !bytes.Equal(newContent, b) {
+			t.Errorf("run %d: unexpected calls of fn: %d, %q, %q", i, calls, oldContent, newContent)
+		}
+	}
+}
+
+func TestParseStdin(t *testing.T) {
+	oldArgs, oldStdin := os.Args, os.Stdin
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args, os.Stdin = oldArgs, oldStdin
+	}()
+
+	f, err := ioutil.TempFile("", "confy_teststdin")
+	if err != nil {
+		t.Fatalf("failed to create tempfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	fmt.Fprintln(f, "port=4\nold=1")
+	f.Seek(0, io.SeekStart)
+	os.Stdin = f
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	port := flag.Int("port", 3, "port")
+	logs := new(bytes.Buffer)
+	res, err := ParseDetailed("confy_stdin", WithPath("-"), WithWriter(logs))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *port != 4 || res.ObsoleteKeys["old"] != "1" {
+		t.Errorf("unexpected result: port=%d obsolete=%v", *port, res.ObsoleteKeys)
+	}
+	if logs.Len() > 0 {
+		t.Errorf("obsolete keys must not be warned about:\n%s", logs)
+	}
+	if b, err := ioutil.ReadFile(f.Name()); err != nil || string(b) != "port=4\nold=1\n" {
+		t.Errorf("nothing must be written back: %q, %v", b, err)
+	}
+	if _, err := os.Stat("-"); !os.IsNotExist(err) {
+		t.Errorf("a file named - must not be created")
+	}
+}
+
+func TestKeyOrder(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flag.Int("port", 0, "port")
+	flag.String("host", "", "host")
+	flag.String("db.user", "", "database user")
+	flag.String("db.name", "", "database name")
+	shorthand := flag.Int("shorthand", 3, "shorthand test")
+	flag.IntVar(shorthand, "s", 3, "shorthand test (shorthand)")
+	flag.Bool("verbose", false, "verbose")
+
+	o := newOptions("confy_test", []Option{WithOmitDefaults(true)})
+	in := `
+# verbose (bool, default false)
+# verbose=false
+
+# port (int, default 0)
+port=1
+
+s=4
+
+[db]
+name=app
+`
+	conf, err := parseConfig(o, bytes.NewBufferString(in))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	// keys of the file come first, in their order, new flags are appended
+	want := `
+# verbose (bool, default false)
+# verbose=false
+
+# port (int, default 0)
+port=1
+
+# shorthand test (int, default 3)
+shorthand=4
+
+# host (string, default )
+# host=
+
+[db]
+
+# database name (string, default )
+name=app
+
+# database user (string, default )
+# user=
+`
+	resWriter := new(bytes.Buffer)
+	saveConfig(o, resWriter, conf)
+	if got := resWriter.String(); got != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+	}
+
+	// new files are written in lexicographical order
+	resWriter = new(bytes.Buffer)
+	saveConfig(o, resWriter, nil)
+	if got := resWriter.String(); !strings.HasPrefix(got, "\n# host (string, default )\n") {
+		t.Errorf("unexpected result:\n%s", got)
+	}
+}
+
+func TestCategory(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flag.Int("port", 0, "port")
+	flag.String("host", "", "host")
+	flag.Bool("verbose", false, "verbose")
+	flag.String("log.file", "", "log file")
+	flag.String("log.level", "", "log level")
+
+	o := newOptions("confy_test", []Option{
+		WithCategory("port", "Network"), WithCategory("host", "Network"),
+		WithCategory("log.level", "Logging"), WithCategory("log.file", "Network"),
+	})
+	want := `
+# --- General ---
+
+# verbose (bool, default false)
+verbose=false
+
+# --- Network ---
+
+# host (string, default )
+host=
+
+# port (int, default 0)
+port=0
+
+[log]
+
+# --- Network ---
+
+# log file (string, default )
+file=
+
+# --- Logging ---
+
+# log level (string, default )
+level=
+`
+	resWriter := new(bytes.Buffer)
+	saveConfig(o, resWriter, nil)
+	if got := resWriter.String(); got != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+	}
+
+	// the headers are regenerated instead of being kept as comments
+	conf, err := parseConfig(o, bytes.NewBufferString("# config\n"+want))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	resWriter = new(bytes.Buffer)
+	saveConfig(o, resWriter, conf)
+	if got := resWriter.String(); got != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+	}
+}
+
+// linesValue is a custom flag.Value with a multi-line String method.
+type linesValue struct {
+	lines []string
+}
+
+func (v *linesValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return strings.Join(v.lines, "\n")
+}
+
+func (v *linesValue) Set(s string) error {
+	v.lines = strings.Split(s, "\n")
+	return nil
+}
+
+func TestCustomValue(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	lines := &linesValue{[]string{"a", "b"}}
+	flag.Var(lines, "lines", "lines")
+	flag.Var(&linesValue{[]string{"x\r", "y\rz"}}, "cr", "carriage returns")
+	var funcs []string
+	flag.Func("func", "func", func(s string) error {
+		funcs = append(funcs, s)
+		return nil
+	})
+	flag.Func("func2", "another func", func(string) error { return nil })
+
+	o := newOptions("confy_test", nil)
+	resWriter := new(bytes.Buffer)
+	saveConfig(o, resWriter, nil)
+	want := `
+# carriage returns (default x
+# y
+# z)
+cr=x\r\ny\rz
+
+# func (default )
+func=
+
+# another func (default )
+func2=
+
+# lines (default a
+# b)
+lines=a\nb
+`
+	if got := resWriter.String(); got != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+	}
+
+	lines.lines = nil
+	conf, err := parseConfig(o, bytes.NewBufferString(resWriter.String()+"func=f\n"))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if got := lines.String(); got != "a\nb" {
+		t.Errorf("lines: (want: %q; got: %q)", "a\nb", got)
+	}
+	if got := flag.Lookup("cr").Value.String(); got != "x\r\ny\rz" {
+		t.Errorf("cr: (want: %q; got: %q)", "x\r\ny\rz", got)
+	}
+	if len(conf.obsolete) > 0 || strings.Join(funcs, ",") != ",f" {
+		t.Errorf("unexpected result: obsolete=%v func=%q", conf.obsolete, funcs)
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_idempotent")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	in := "\ufeff# notes\r\n\r\nPORT : 5\r\ntimeout=90m\r\n[db]\r\nhost = 'x y'  # inline\r\nverbose\r\n[]\r\n" +
+		"tags=a, b,\"c,d\"\r\nsecret=abc\r\nzzz=1\r\nold=\"q\" # c\r\n# trailing\r\n"
+
+	for n, opts := range [][]Option{
+		nil,
+		{WithOmitDefaults(true), WithCategory("port", "Network")},
+		{WithWrap(12)},
+		{WithCodec(jsonCodec{})},
+		{WithCodec(tomlCodec{})},
+	} {
+		// codecs start without a file, the text format with a hand written one
+		cPath := filepath.Join(dir, fmt.Sprint("config", n))
+		if _, ok := newOptions("", opts).format.(textFormat); ok {
+			if err := ioutil.WriteFile(cPath, []byte(in), 0600); err != nil {
+				t.Fatalf("failed to create config file")
+			}
+		}
+
+		var content []byte
+		var modTime time.Time
+		for i := 0; i < 2; i++ {
+			fs := flag.NewFlagSet("idempotent", flag.ContinueOnError)
+			fs.Int("port", 0, "port")
+			fs.Duration("timeout", time.Minute, "timeout")
+			fs.String("db.host", "", "database host")
+			fs.Bool("db.verbose", false, "verbose")
+			fs.String("secret", "", "secret")
+			fs.String("name", "a long default value", "name")
+			var tags listValue
+			fs.Var(&tags, "tags", "tags")
+			res, err := ParseDetailed("confy_idempotent", append(opts, WithPath(cPath), WithFlagSet(fs), WithWriter(ioutil.Discard),
+				WithSecret("secret"), WithList(",", "tags"))...)
+			if err != nil {
+				t.Fatalf("%d: unexpected error occurred: %v", n, err)
+			}
+			b, err := ioutil.ReadFile(cPath)
+			if err != nil {
+				t.Fatalf("failed to read config file: %v", err)
+			}
+			fi, err := os.Stat(cPath)
+			if err != nil {
+				t.Fatalf("failed to stat config file: %v", err)
+			}
+			if i == 0 {
+				// make a rewrite detectable on file systems with coarse times
+				modTime = fi.ModTime().Add(-time.Hour)
+				if err := os.Chtimes(cPath, modTime, modTime); err != nil {
+					t.Fatalf("failed to change the modification time: %v", err)
+				}
+				content = b
+				continue
+			}
+			if res.Changed || !bytes.Equal(b, content) {
+				t.Errorf("%d: the unchanged file was rewritten:\nFIRST:\n%s\n\nSECOND:\n%s\n", n, content, b)
+			}
+			if !fi.ModTime().Equal(modTime) {
+				t.Errorf("%d: the modification time changed from %v to %v", n, modTime, fi.ModTime())
+			}
+		}
+	}
+}
+
+func TestAlias(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	listen := flag.String("listen-address", "", "listen address")
+	user := flag.String("db.user", "", "database user")
+
+	o := newOptions("confy_test", []Option{WithAlias("addr", "listen-address"), WithAlias("db.login", "db.user"), WithAlias("gone", "missing")})
+	conf, err := parseConfig(o, bytes.NewBufferString(`
+# my listener
+ADDR=:8080
+gone=1
+
+[db]
+login=admin`))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *listen != ":8080" || *user != "admin" {
+		t.Errorf("unexpected values: %q, %q", *listen, *user)
+	}
+	if len(conf.obsolete) != 1 || conf.obsolete["gone"] != "1" {
+		t.Errorf("only keys without flag must be obsolete: %v", conf.obsolete)
+	}
+	want := `
+# my listener
+# listen address (string, default )
+listen-address=:8080
+
+[db]
+
+# database user (string, default )
+user=admin
+
+
+# The following options are probably deprecated and not used currently!
+[]
+gone=1
+`
+	resWriter := new(bytes.Buffer)
+	saveConfig(o, resWriter, conf)
+	if got := resWriter.String(); got != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+	}
+
+	// codecs resolve aliases as well
+	*listen = ""
+	if _, err := (codecFormat{jsonCodec{}}).parse(o, strings.NewReader(`{"addr": ":9090"}`)); err != nil || *listen != ":9090" {
+		t.Errorf("listen-address: (want: %q; got: %q, %v)", ":9090", *listen, err)
+	}
+}
+
+func TestAliasSpellings(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	color := flag.String("color", "", "color")
+
+	logs := new(bytes.Buffer)
+	o := newOptions("confy_test", []Option{WithAlias("colour", "color"), WithAlias("farbe", "color"), WithWriter(logs)})
+	conf, err := parseConfig(o, bytes.NewBufferString("colour=red\nFarbe=red\n"))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *color != "red" || logs.Len() > 0 {
+		t.Errorf("aliases with the same value must not be warned about: %q\n%s", *color, logs)
+	}
+
+	if conf, err = parseConfig(o, bytes.NewBufferString("colour=red\ncolor=blue\n")); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	want := "WARNING: color in line 2 overrides colour in line 1, color is set to \"blue\" instead of \"red\"\n"
+	if *color != "blue" || logs.String() != want {
+		t.Errorf("unexpected result: %q\n%s", *color, logs)
+	}
+	resWriter := new(bytes.Buffer)
+	saveConfig(o, resWriter, conf)
+	if got := resWriter.String(); got != "\n# color (string, default )\ncolor=blue\n" {
+		t.Errorf("only the flag name must be written:\n%s", got)
+	}
+
+	if _, err := parseConfig(newOptions("confy_test", []Option{WithAlias("colour", "color"), WithStrict(true)}),
+		bytes.NewBufferString("colour=red\ncolor=blue\n")); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("expected a duplicate key in strict mode, got: %v", err)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	f, err := ioutil.TempFile("", "confy_testprofile")
+	if err != nil {
+		t.Fatalf("failed to create tempfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, `# header
+
+# development settings
+[profile:dev]
+  port=2   # local
+debug
+
+[profile:prod]
+port=3
+db.host=db.example.com
+gone=1
+
+[]
+# shared port
+port=1
+old=1
+`)
+	f.Close()
+
+	newFlags := func() (*int, *bool, *string) {
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		return flag.Int("port", 0, "port"), flag.Bool("debug", false, "debug"), flag.String("db.host", "localhost", "database host")
+	}
+	port, debug, host := newFlags()
+	logs := new(bytes.Buffer)
+	if err := ParseWith("confy_profile", WithPath(f.Name()), WithProfile("dev"), WithHeader("header"), WithWriter(logs)); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *port != 2 || !*debug || *host != "localhost" {
+		t.Errorf("unexpected values: %d, %v, %q", *port, *debug, *host)
+	}
+	want := `# header
+
+# shared port
+# port (int, default 0)
+port=1
+
+# debug (bool, default false)
+debug=false
+
+[db]
+
+# database host (string, default localhost)
+host=localhost
+
+# development settings
+[profile:dev]
+  port=2   # local
+debug
+
+[profile:prod]
+port=3
+db.host=db.example.com
+gone=1
+
+
+# The following options are probably deprecated and not used currently!
+[]
+old=1
+`
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("failed to read config file: %v", err)
+	}
+	if string(b) != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, b)
+	}
+
+	// the rewritten file selects the same values
+	port, debug, host = newFlags()
+	if err := ParseWith("confy_profile", WithPath(f.Name()), WithProfile("PROD"), WithHeader("header"), WithWriter(logs)); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *port != 3 || *debug || *host != "db.example.com" {
+		t.Errorf("unexpected values: %d, %v, %q", *port, *debug, *host)
+	}
+	if b2, _ := ioutil.ReadFile(f.Name()); !bytes.Equal(b, b2) {
+		t.Errorf("unexpected rewrite:\n%s", b2)
+	}
+
+	// without profile only the shared keys are applied
+	port, _, _ = newFlags()
+	if err := ParseWith("confy_profile", WithPath(f.Name()), WithWriter(logs)); err != nil || *port != 1 {
+		t.Errorf("port: (want: 1; got: %d, %v)", *port, err)
+	}
+	newFlags()
+	logs.Reset()
+	if err := ParseWith("confy_profile", WithPath(f.Name()), WithProfile("test"), WithWriter(logs)); err != nil || !strings.Contains(logs.String(), "profile test not found") {
+		t.Errorf("expected a warning about the missing profile, got: %v\n%s", err, logs)
+	}
+
+	// errors report the lines of the config file
+	newFlags()
+	ioutil.WriteFile(f.Name(), []byte("port=1\n[profile:dev]\nport=x\n"), 0600)
+	if err := ParseWith("confy_profile", WithPath(f.Name()), WithProfile("dev"), WithWriter(logs)); err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("expected an error in line 3, got: %v", err)
+	}
+}
+
+func TestCreateOnFirstRun(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	configHome, err := ioutil.TempDir("", "confy_test_config")
+	if err != nil {
+		t.Fatalf("failed to create temporary config directory")
+	}
+	defer os.RemoveAll(configHome)
+	oldConfigHome := os.Getenv("XDG_CONFIG_HOME")
+	os.Setenv("XDG_CONFIG_HOME", configHome)
+	defer os.Setenv("XDG_CONFIG_HOME", oldConfigHome)
+	currentUser = func() (*user.User, error) {
+		return &user.User{HomeDir: configHome}, nil
+	}
+	goos = "linux"
+	defer func() {
+		currentUser, goos = user.Current, runtime.GOOS
+	}()
+
+	parse := func(opts ...Option) error {
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		flag.Int("port", 3, "port")
+		return ParseWith("confy_create", opts...)
+	}
+	dir := filepath.Join(configHome, "confy_create")
+	cPath := filepath.Join(dir, "config.ini")
+	if err := parse(WithCreateOnFirstRun(false)); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("neither the config file nor its directory must be created: %v", err)
+	}
+
+	// files located by the environment variable are not created either
+	envPath := filepath.Join(configHome, "env.ini")
+	os.Setenv("CONFY_CREATEINF0", envPath)
+	if err := parse(WithCreateOnFirstRun(false), WithFileLock(time.Second)); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if _, err := os.Stat(envPath); !os.IsNotExist(err) {
+		t.Errorf("the config file must not be created: %v", err)
+	}
+	if _, err := os.Stat(envPath + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("the lock file must not be created: %v", err)
+	}
+	// but existing empty files are populated
+	if err := ioutil.WriteFile(envPath, nil, 0600); err != nil {
+		t.Fatalf("failed to create config file")
+	}
+	if err := parse(WithCreateOnFirstRun(false)); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if b, err := ioutil.ReadFile(envPath); err != nil || !strings.Contains(string(b), "\nport=3\n") {
+		t.Errorf("unexpected config file: %q, %v", b, err)
+	}
+	os.Unsetenv("CONFY_CREATEINF0")
+
+	// by default the file and its private directory are created
+	if err := parse(); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() || fi.Mode().Perm() != 0700 {
+		t.Errorf("config dir was not created with mode 0700: %v", err)
+	}
+	if _, err := os.Stat(cPath); err != nil {
+		t.Errorf("config file was not created: %v", err)
+	}
+}
+
+func TestMaxLineLength(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	name := flag.String("name", "", "name")
+
+	// the default allows long lines
+	long := strings.Repeat("x", 100000)
+	if _, err := parseConfig(newOptions("confy_test", nil), strings.NewReader("port=1\nname="+long+"\n")); err != nil || *name != long {
+		t.Errorf("unexpected result: %d, %v", len(*name), err)
+	}
+
+	_, err := parseConfig(newOptions("confy_test", []Option{WithMaxLineLength(10)}), strings.NewReader("name=short\n\nname="+long+"\nname=x\n"))
+	if !errors.Is(err, bufio.ErrTooLong) {
+		t.Fatalf("expected bufio.ErrTooLong, got: %v", err)
+	}
+	if want := "line 3: bufio.Scanner: token too long, the limit is 10 bytes"; err.Error() != want {
+		t.Errorf("error: (want: %q; got: %q)", want, err.Error())
+	}
+
+	// the codecs of this package are limited as well
+	for c, file := range map[ConfigCodec]string{
+		jsonCodec{}:   "{\n\"name\": \"" + long + "\"\n}\n",
+		tomlCodec{}:   "name = \"short\"\nname = \"" + long + "\"\n",
+		dotenvCodec{}: "NAME=short\nNAME=" + long + "\n",
+	} {
+		o := newOptions("confy_test", []Option{WithCodec(c), WithMaxLineLength(20)})
+		if _, err := o.format.parse(o, strings.NewReader(file)); !errors.Is(err, bufio.ErrTooLong) || !strings.HasPrefix(err.Error(), "line 2: ") {
+			t.Errorf("%T: expected bufio.ErrTooLong in line 2, got: %v", c, err)
+		}
+	}
+}
+
+func TestKeyStyle(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	level := flag.String("log-level", "info", "log level")
+	user := flag.String("my-db.user-name", "", "database user")
+	flag.String("snake_case", "", "snake case")
+
+	o := newOptions("confy_test", []Option{WithKeyStyle(KeyUnderscore)})
+	conf, err := parseConfig(o, strings.NewReader("log_level=debug\n[my_db]\nuser-name=app\n[]\nsnake-case=x\n"))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *level != "debug" || *user != "app" || len(conf.obsolete) > 0 {
+		t.Errorf("unexpected values: %q, %q, %v", *level, *user, conf.obsolete)
+	}
+
+	resWriter := new(bytes.Buffer)
+	saveConfig(o, resWriter, conf)
+	want := `
+# log level (string, default info)
+log_level=debug
+
+# snake case (string, default )
+snake_case=x
+
+[my_db]
+
+# database user (string, default )
+user_name=app
+`
+	if got := resWriter.String(); !strings.HasSuffix(got, want) {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+	}
+
+	// the default style keeps the flag names
+	resWriter.Reset()
+	saveConfig(newOptions("confy_test", nil), resWriter, conf)
+	if got := resWriter.String(); !strings.Contains(got, "\nlog-level=debug\n") || !strings.Contains(got, "\n[my-db]\n") || !strings.Contains(got, "\nsnake_case=x\n") {
+		t.Errorf("unexpected result:\n%s", got)
+	}
+
+	// both spellings in one file are duplicates rather than aliases
+	logged := new(bytes.Buffer)
+	o = newOptions("confy_test", []Option{WithKeyStyle(KeyUnderscore), WithWriter(logged)})
+	if _, err := parseConfig(o, strings.NewReader("log-level=warn\nlog_level=debug\n")); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if want := "WARNING: duplicate key log-level in line 2 overrides line 1\n"; logged.String() != want {
+		t.Errorf("unexpected warnings:\nWANT:\n%s\nGOT:\n%s", want, logged)
+	}
+}
+
+func TestWhitespace(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	port := flag.Int("port", 0, "port")
+	name := flag.String("name", "", "name")
+	host := flag.String("db.host", "", "database host")
+	debug := flag.Bool("debug", false, "debug")
+
+	conf, err := parseConfig(newOptions("confy_test", nil), bytes.NewBufferString(
+		"\t\tport\t=\t8080\t\n"+
+			"   name :  ' padded '  \n"+
+			" debug \n"+
+			"my key = 1\n"+
+			"\t[ db ]\n"+
+			"\t  host = db.\\\n"+
+			"\t\t  example.com\n"))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *port != 8080 || *name != " padded " || !*debug || *host != "db.example.com" {
+		t.Errorf("unexpected values: %d, %q, %v, %q", *port, *name, *debug, *host)
+	}
+	if len(conf.obsolete) != 1 || conf.obsolete["my key"] != "1" {
+		t.Errorf("whitespace within keys must be kept: %v", conf.obsolete)
+	}
+}
+
+func TestSemicolonComments(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	port := flag.Int("port", 0, "port")
+	name := flag.String("name", "", "name")
+
+	o := newOptions("confy_test", nil)
+	conf, err := parseConfig(o, bytes.NewBufferString("\n; the port\nport=8080\n  ; name=ignored\n;obsolete=1\nname=a;b\n"))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *port != 8080 || *name != "a;b" || len(conf.obsolete) > 0 {
+		t.Errorf("unexpected values: %d, %q, %v", *port, *name, conf.obsolete)
+	}
+
+	// the comments are kept, new ones are written with #
+	resWriter := new(bytes.Buffer)
+	saveConfig(o, resWriter, conf)
+	want := "\n; the port\n# port (int, default 0)\nport=8080\n\n; name=ignored\n;obsolete=1\n# name (string, default )\nname=a;b\n"
+	if got := resWriter.String(); !strings.HasSuffix(got, want) {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+	}
+}
+
+type memFile struct {
+	data []byte
+	off  int
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.off >= len(f.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[f.off:])
+	f.off += n
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if end := f.off + len(p); end > len(f.data) {
+		f.data = append(f.data[:f.off], make([]byte, end-f.off)...)
+	}
+	n := copy(f.data[f.off:], p)
+	f.off += n
+	return n, nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += int64(f.off)
+	case io.SeekEnd:
+		offset += int64(len(f.data))
+	}
+	f.off = int(offset)
+	return offset, nil
+}
+
+func TestOpener(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	files := make(map[string]*memFile)
+	opener := WithOpener(func(path string, flag int, perm os.FileMode) (io.ReadWriteSeeker, error) {
+		f, ok := files[path]
+		if !ok && flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+		} else if !ok || flag&os.O_TRUNC != 0 {
+			f = new(memFile)
+			files[path] = f
+		}
+		f.off = 0
+		return f, nil
+	})
+
+	// the defaults are written without touching the file system
+	fs := flag.NewFlagSet("opener", flag.ContinueOnError)
+	fs.Int("port", 3, "port")
+	if err := ParseWith("confy_opener", WithPath("/confy/missing/config"), WithFlagSet(fs), opener); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if _, err := os.Stat("/confy/missing"); !os.IsNotExist(err) {
+		t.Errorf("no directory must be created for a custom opener")
+	}
+	if f := files["/confy/missing/config"]; f == nil || !strings.Contains(string(f.data), "\nport=3\n") {
+		t.Fatalf("the defaults must be written: %v", f)
+	}
+
+	// existing files are rewritten in place and truncated
+	files["/confy/missing/config"].data = []byte("port=4\nobsolete=a long value to be truncated\n")
+	fs = flag.NewFlagSet("opener", flag.ContinueOnError)
+	port := fs.Int("port", 3, "port")
+	err := ParseWith("confy_opener", WithPath("/confy/missing/config"), WithFlagSet(fs), WithBackup(true),
+		WithUpdateWarning(false), opener)
+	if err != nil || *port != 4 {
+		t.Fatalf("unexpected result: %d, %v", *port, err)
+	}
+	want := "port=4\n\n\n# " + obsoleteBanner + "\nobsolete=a long value to be truncated\n"
+	if got := string(files["/confy/missing/config"].data); !strings.HasSuffix(got, want) || strings.Count(got, "obsolete=") != 1 {
+		t.Errorf("unexpected content:\n%s", got)
+	}
+	if b := files["/confy/missing/config.bak"]; b == nil || string(b.data) != "port=4\nobsolete=a long value to be truncated\n" {
+		t.Errorf("unexpected backup: %v", b)
+	}
+
+	// shorter content must not leave the end of the previous content behind
+	content := string(files["/confy/missing/config"].data)
+	files["/confy/missing/config"].data = []byte(content + strings.Repeat("\n", 100))
+	fs = flag.NewFlagSet("opener", flag.ContinueOnError)
+	fs.Int("port", 3, "port")
+	if err := ParseWith("confy_opener", WithPath("/confy/missing/config"), WithFlagSet(fs),
+		WithUpdateWarning(false), opener); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if got := string(files["/confy/missing/config"].data); got != content {
+		t.Errorf("unexpected content:\n%q", got)
+	}
+}
+
+func TestUpdateConfig(t *testing.T) {
+	fs := flag.NewFlagSet("update", flag.ContinueOnError)
+	port := fs.Int("port", 3, "port")
+	o := newOptions("confy_update", []Option{WithFlagSet(fs), WithBackup(true), WithUpdateWarning(false)})
+	o.path = "config"
+
+	written := make(map[string]string)
+	replace := func(name string, content []byte) error {
+		written[name] = string(content)
+		return nil
+	}
+	var res ParseResult
+	conf, err := updateConfig(o, strings.NewReader("port=4\nold=1\n"), map[string]string{"base": "2"}, replace, &res)
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *port != 4 || !res.Changed || res.FirstRun || len(res.ObsoleteKeys) != 2 || conf.obsolete["base"] != "2" {
+		t.Errorf("unexpected result: %d, %+v", *port, res)
+	}
+	if len(written) != 2 || written["config.bak"] != "port=4\nold=1\n" || !strings.Contains(written["config"], "\nbase=2\n") {
+		t.Errorf("unexpected writes: %q", written)
+	}
+
+	// unchanged or read-only configs are not written
+	content := written["config"]
+	written = make(map[string]string)
+	if _, err := updateConfig(o, strings.NewReader(content), map[string]string{"base": "2"}, replace, &res); err != nil || res.Changed || len(written) > 0 {
+		t.Errorf("unchanged config must not be written: %q, %v", written, err)
+	}
+	if _, err := updateConfig(o, strings.NewReader("port=5\n"), nil, nil, &res); err != nil || !res.Changed || len(written) > 0 {
+		t.Errorf("read-only config must not be written: %q, %v", written, err)
+	}
+
+	// without backups, the previous content is compared by its digest
+	o = newOptions("confy_update", []Option{WithFlagSet(fs), WithUpdateWarning(false)})
+	o.path = "config"
+	if _, err := updateConfig(o, strings.NewReader(content), map[string]string{"base": "2"}, replace, &res); err != nil || res.Changed || res.FirstRun || len(written) > 0 {
+		t.Errorf("unchanged config must not be written: %q, %+v, %v", written, res, err)
+	}
+	if _, err := updateConfig(o, strings.NewReader(content+"\n"), map[string]string{"base": "2"}, replace, &res); err != nil || !res.Changed || written["config"] != content {
+		t.Errorf("changed config must be written: %q, %+v, %v", written, res, err)
+	}
+
+	failed := errors.New("failed")
+	_, err = updateConfig(o, strings.NewReader(""), nil, func(string, []byte) error { return failed }, &res)
+	if !errors.Is(err, failed) || !errors.Is(err, ErrWrite) {
+		t.Errorf("expected the write error, got: %v", err)
+	}
+}
+
+func TestIgnoreCommentChanges(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_comments")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "config")
+
+	parse := func(usage string, opts ...Option) ParseResult {
+		fs := flag.NewFlagSet("comments", flag.ContinueOnError)
+		fs.Int("port", 3, usage)
+		res, err := ParseDetailed("confy_comments", append(opts, WithPath(cPath), WithFlagSet(fs))...)
+		if err != nil {
+			t.Fatalf("unexpected error occurred: %v", err)
+		}
+		return res
+	}
+	parse("port")
+	content, _ := ioutil.ReadFile(cPath)
+
+	// only the usage changed, with or without keeping the old content
+	if res := parse("the port", WithIgnoreCommentChanges(true)); res.Changed {
+		t.Errorf("a changed usage must be ignored")
+	}
+	if res := parse("the port", WithIgnoreCommentChanges(true), WithBackup(true)); res.Changed {
+		t.Errorf("a changed usage must be ignored with backups")
+	}
+	if b, _ := ioutil.ReadFile(cPath); string(b) != string(content) {
+		t.Errorf("the file must not be rewritten:\n%s", b)
+	}
+
+	// values and usage changes without the option are written
+	if err := ioutil.WriteFile(cPath, append(content, "\n# my comment\nport=4\n"...), 0600); err != nil {
+		t.Fatalf("failed to write config file")
+	}
+	if res := parse("the port", WithIgnoreCommentChanges(true)); !res.Changed {
+		t.Errorf("a changed value must be written")
+	}
+	if res := parse("the port number"); !res.Changed {
+		t.Errorf("a changed usage must be written without the option")
+	}
+	if b, _ := ioutil.ReadFile(cPath); !strings.Contains(string(b), "# the port number") {
+		t.Errorf("the usage must be updated:\n%s", b)
+	}
+}
+
+func TestObsoletePromotion(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_promotion")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(cPath, []byte("port=4\nname=app\nlimit=many\n"), 0600); err != nil {
+		t.Fatalf("failed to create config file")
+	}
+
+	// the first version only knows port, the others become obsolete
+	fs := flag.NewFlagSet("promotion", flag.ContinueOnError)
+	fs.Int("port", 3, "port")
+	res, err := ParseDetailed("confy_promotion", WithPath(cPath), WithFlagSet(fs), WithUpdateWarning(false))
+	if err != nil || len(res.ObsoleteKeys) != 2 {
+		t.Fatalf("unexpected result: %v, %v", res.ObsoleteKeys, err)
+	}
+
+	// the next version adds name and limit, the invalid limit stays obsolete
+	logs := new(bytes.Buffer)
+	fs = flag.NewFlagSet("promotion", flag.ContinueOnError)
+	fs.Int("port", 3, "port")
+	name := fs.String("name", "", "name")
+	limit := fs.Int("limit", 10, "limit")
+	for i := 0; i < 2; i++ {
+		res, err = ParseDetailed("confy_promotion", WithPath(cPath), WithFlagSet(fs), WithUpdateWarning(false), WithWriter(logs))
+		if err != nil || *name != "app" || *limit != 10 {
+			t.Fatalf("unexpected result: %q, %d, %v", *name, *limit, err)
+		}
+		if len(res.ObsoleteKeys) != 1 || res.ObsoleteKeys["limit"] != "many" {
+			t.Errorf("run %d: unexpected obsolete keys: %v", i, res.ObsoleteKeys)
+		}
+		fs = flag.NewFlagSet("promotion", flag.ContinueOnError)
+		fs.Int("port", 3, "port")
+		name = fs.String("name", "", "name")
+		limit = fs.Int("limit", 10, "limit")
+	}
+	want := `
+# port (int, default 3)
+port=4
+
+# name (string, default )
+name=app
+
+# limit (int, default 10)
+limit=10
+
+
+# The following options are probably deprecated and not used currently!
+limit=many
+`
+	if b, _ := ioutil.ReadFile(cPath); !strings.HasSuffix(string(b), want) {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, b)
+	}
+	if strings.Count(logs.String(), "keeping obsolete key limit") != 2 || strings.Contains(logs.String(), "duplicate") {
+		t.Errorf("unexpected warnings:\n%s", logs)
+	}
+}
+
+func TestCommentedObsolete(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_commented")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(cPath, []byte("port=4\n# the old key\nold=1 # note\n"), 0600); err != nil {
+		t.Fatalf("failed to create config file")
+	}
+
+	for i, wantChanged := range []bool{true, false} {
+		fs := flag.NewFlagSet("commented", flag.ContinueOnError)
+		fs.Int("port", 3, "port")
+		res, err := ParseDetailed("confy_commented", WithPath(cPath), WithFlagSet(fs), WithUpdateWarning(false), WithCommentedObsolete(true))
+		if err != nil || res.Changed != wantChanged || res.ObsoleteKeys["old"] != "1" {
+			t.Fatalf("run %d: unexpected result: %+v, %v", i, res, err)
+		}
+	}
+	want := `
+# port (int, default 3)
+port=4
+
+
+# The following options are probably deprecated and not used currently!
+# the old key
+# old=1 # note  (unknown flag, ignored)
+`
+	if b, _ := ioutil.ReadFile(cPath); !strings.HasSuffix(string(b), want) {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, b)
+	}
+
+	// the obsolete keys following a profile are kept as well
+	if err := ioutil.WriteFile(cPath, []byte("port=4\n[profile:dev]\nport=5\n[]\nold=1\n"), 0600); err != nil {
+		t.Fatalf("failed to create config file")
+	}
+	for i, wantChanged := range []bool{true, false} {
+		fs := flag.NewFlagSet("commented", flag.ContinueOnError)
+		fs.Int("port", 3, "port")
+		res, err := ParseDetailed("confy_commented", WithPath(cPath), WithFlagSet(fs), WithUpdateWarning(false), WithCommentedObsolete(true))
+		if err != nil || res.Changed != wantChanged || res.ObsoleteKeys["old"] != "1" {
+			b, _ := ioutil.ReadFile(cPath)
+			t.Fatalf("run %d: unexpected result: %+v, %v\n%s", i, res, err, b)
+		}
+	}
+	want = `
+[profile:dev]
+port=5
+
+
+# The following options are probably deprecated and not used currently!
+[]
+# old=1  (unknown flag, ignored)
+`
+	if b, _ := ioutil.ReadFile(cPath); !strings.HasSuffix(string(b), want) {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, b)
+	}
+
+	// flags added again take over the commented out values
+	fs := flag.NewFlagSet("commented", flag.ContinueOnError)
+	fs.Int("port", 3, "port")
+	old := fs.Int("old", 0, "old")
+	res, err := ParseDetailed("confy_commented", WithPath(cPath), WithFlagSet(fs), WithCommentedObsolete(true))
+	if err != nil || *old != 1 || len(res.ObsoleteKeys) > 0 {
+		t.Errorf("unexpected result: %d, %v, %v", *old, res.ObsoleteKeys, err)
+	}
+}
+
+func TestDeprecatedPlacement(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	// at the top, the obsolete keys end before the flags
+	fs := flag.NewFlagSet("placement", flag.ContinueOnError)
+	port := fs.Int("port", 3, "port")
+	o := newOptions("confy_placement", []Option{WithFlagSet(fs), WithDeprecatedPlacement(DeprecatedTop), WithHeader("")})
+	conf, err := o.format.parse(o, strings.NewReader("port=4\nold=1\n"))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	want := `
+
+# The following options are probably deprecated and not used currently!
+old=1
+# End of the deprecated options.
+
+# port (int, default 3)
+port=4
+`
+	resWriter := new(bytes.Buffer)
+	o.format.save(o, resWriter, conf)
+	if got := resWriter.String(); got != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+	}
+	if conf, err = o.format.parse(o, strings.NewReader(want)); err != nil || *port != 4 || conf.obsolete["old"] != "1" {
+		t.Errorf("unexpected result: %d, %v, %v", *port, conf.obsolete, err)
+	}
+	// invalid values after the end are errors again
+	if _, err := o.format.parse(o, strings.NewReader(want+"port=x\n")); err == nil {
+		t.Errorf("expected an error for an invalid value after the obsolete keys")
+	}
+
+	dir, err := ioutil.TempDir("", "confy_test_placement")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(cPath, []byte("port=4\nold=1\n"), 0600); err != nil {
+		t.Fatalf("failed to create config file")
+	}
+
+	// in a separate file, which is applied on the next run
+	logs := new(bytes.Buffer)
+	for i := 0; i < 2; i++ {
+		fs = flag.NewFlagSet("placement", flag.ContinueOnError)
+		fs.Int("port", 3, "port")
+		res, err := ParseDetailed("confy_placement", WithPath(cPath), WithFlagSet(fs), WithWriter(logs),
+			WithDeprecatedPlacement(DeprecatedFile))
+		if err != nil || res.ObsoleteKeys["old"] != "1" {
+			t.Fatalf("run %d: unexpected result: %v, %v", i, res.ObsoleteKeys, err)
+		}
+		if b, _ := ioutil.ReadFile(cPath); strings.Contains(string(b), "old") {
+			t.Errorf("run %d: the config file must not contain the obsolete keys:\n%s", i, b)
+		}
+		if b, _ := ioutil.ReadFile(cPath + ".deprecated"); string(b) != "# "+obsoleteBanner+"\nold=1\n" {
+			t.Errorf("run %d: unexpected obsolete keys:\n%s", i, b)
+		}
+	}
+	if !strings.Contains(logs.String(), "Check and update "+cPath+".deprecated as necessary") {
+		t.Errorf("the warning must point to the obsolete keys:\n%s", logs)
+	}
+
+	// the file is removed once its keys are used again
+	fs = flag.NewFlagSet("placement", flag.ContinueOnError)
+	fs.Int("port", 3, "port")
+	old := fs.Int("old", 0, "old")
+	res, err := ParseDetailed("confy_placement", WithPath(cPath), WithFlagSet(fs), WithDeprecatedPlacement(DeprecatedFile))
+	if err != nil || *old != 1 || len(res.ObsoleteKeys) > 0 {
+		t.Fatalf("unexpected result: %d, %v, %v", *old, res.ObsoleteKeys, err)
+	}
+	if _, err := os.Stat(cPath + ".deprecated"); !os.IsNotExist(err) {
+		t.Errorf("the file of obsolete keys must be removed")
+	}
+	if b, _ := ioutil.ReadFile(cPath); !strings.Contains(string(b), "\nold=1\n") {
+		t.Errorf("the key must be written to the config file:\n%s", b)
+	}
+}
+
+func TestForce(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_force")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "config")
+
+	fs := flag.NewFlagSet("force", flag.ContinueOnError)
+	port := fs.Int("port", 3, "port")
+	if err := ParseWith("confy_force", WithPath(cPath), WithFlagSet(fs)); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if err := ioutil.WriteFile(cPath, []byte("port=4\n"), 0600); err != nil {
+		t.Fatalf("failed to write config file")
+	}
+	if err := ParseWith("confy_force", WithPath(cPath), WithFlagSet(fs)); !errors.Is(err, ErrAlreadyParsed) {
+		t.Errorf("expected ErrAlreadyParsed without force, got: %v", err)
+	}
+	if err := ParseWith("confy_force", WithPath(cPath), WithFlagSet(fs), WithForce(true)); err != nil || *port != 4 {
+		t.Errorf("port: (want: 4; got: %d, %v)", *port, err)
+	}
+
+	// flag.CommandLine is never parsed twice
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flag.CommandLine.Parse(nil)
+	if err := ParseWith("confy_force", WithPath(cPath), WithForce(true)); !errors.Is(err, ErrAlreadyParsed) {
+		t.Errorf("expected ErrAlreadyParsed for flag.CommandLine, got: %v", err)
+	}
+}
+
+func TestUsageType(t *testing.T) {
+	fs := flag.NewFlagSet("usage", flag.ContinueOnError)
+	fs.Float64("ratio", 0.5, "the ratio")
+	fs.Uint("count", 1, "a `number` of items")
+	fs.Func("func", "custom", func(string) error { return nil })
+	fs.Bool("debug", false, "debug")
+	for name, want := range map[string]string{
+		"ratio": "the ratio (float, default 0.5)",
+		"count": "a number of items (number, default 1)",
+		"func":  "custom (default )",
+		"debug": "debug (bool, default false)",
+	} {
+		if got := usageText(fs.Lookup(name)); got != want {
+			t.Errorf("%s: (want: %q; got: %q)", name, want, got)
+		}
+	}
+
+	// outdated usage comments of the flag are dropped, as well as those
+	// written before the type was documented
+	fs.Int("workers", 1, "workers")
+	o := newOptions("confy_usage", []Option{WithFlagSet(fs)})
+	workers := fs.Lookup("workers")
+	for _, line := range []string{"# old usage (int, default 1)", "# workers (default 1)"} {
+		if got := flagComments(o, workers, []string{"# mine", "", line}); !equalLines(got, []string{"# mine", ""}) {
+			t.Errorf("%s: unexpected user comments: %q", line, got)
+		}
+	}
+	if got := flagComments(o, fs.Lookup("func"), []string{"# old usage (default )"}); got != nil {
+		t.Errorf("unexpected user comments: %q", got)
+	}
+	// but only those of the flag, and the lines before them are kept
+	for _, lines := range [][]string{
+		{"# see (a, default b) later"},
+		{"# mine", "# old usage (int, default 2)"},
+		{"# mine", "# old usage (default 1)"},
+	} {
+		if got := flagComments(o, workers, lines); !equalLines(got, lines) {
+			t.Errorf("unexpected user comments: %q", got)
+		}
+	}
+	if got := flagComments(o, workers, []string{"# mine", "# old usage (int, default 1)"}); !equalLines(got, []string{"# mine"}) {
+		t.Errorf("unexpected user comments: %q", got)
+	}
+}
+
+func TestNumericText(t *testing.T) {
+	fs := flag.NewFlagSet("numeric", flag.ContinueOnError)
+	port := fs.Int("port", 3, "port")
+	rate := fs.Float64("rate", 1, "rate")
+	mode := fs.Int("mode", 1, "mode")
+	o := newOptions("confy_numeric", []Option{WithFlagSet(fs), WithHeader("")})
+
+	// other spellings of the parsed values are kept
+	want := `
+# rate (float, default 1)
+rate=1.50
+
+# mode (int, default 1)
+mode=0755
+
+# port (int, default 3)
+port=0x1F90
+`
+	conf, err := o.format.parse(o, strings.NewReader(want))
+	if err != nil || *port != 8080 || *rate != 1.5 || *mode != 0755 {
+		t.Fatalf("unexpected values: %d, %v, %o, %v", *port, *rate, *mode, err)
+	}
+	resWriter := new(bytes.Buffer)
+	o.format.save(o, resWriter, conf)
+	if got := resWriter.String(); got != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+	}
+
+	// changed values are written as reported by the flags
+	*rate = 2.50
+	resWriter = new(bytes.Buffer)
+	o.format.save(o, resWriter, conf)
+	if !strings.Contains(resWriter.String(), "\nrate=2.5\n") {
+		t.Errorf("unexpected result:\n%s", resWriter)
+	}
+
+	// leading zeros denote octal numbers, like on the command line
+	if _, err := o.format.parse(o, strings.NewReader("port=08080\n")); err == nil {
+		t.Errorf("expected an error for an invalid octal number")
+	}
+}
+
+func TestSeparatorWhitespace(t *testing.T) {
+	// including Unicode spaces like the no-break and the ideographic space
+	spaces := []string{"", " ", "  ", "\t", "\t\t", " \t ", "\u00a0", "\u3000", "\v\f"}
+	for _, sep := range []string{"=", ":"} {
+		for _, before := range spaces {
+			for _, after := range spaces {
+				fs := flag.NewFlagSet("whitespace", flag.ContinueOnError)
+				port := fs.String("port", "", "port")
+				o := newOptions("confy_test", []Option{WithFlagSet(fs)})
+				line := before + "port" + before + sep + after + "8080" + after + "\n"
+				conf, err := parseConfig(o, strings.NewReader(line))
+				if err != nil || *port != "8080" || len(conf.obsolete) > 0 {
+					t.Errorf("%q: unexpected result: %q, %v, %v", line, *port, conf.obsolete, err)
+				}
+			}
+		}
+	}
+}
+
+func TestApplyAndPersist(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_persist")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "config")
+
+	for i, seed := range []string{"abc", "xyz"} {
+		fs := flag.NewFlagSet("persist", flag.ContinueOnError)
+		id := fs.String("id", "", "machine id")
+		err := ApplyAndPersist("confy_persist", map[string]string{"id": seed}, WithPath(cPath), WithFlagSet(fs))
+		// the value of the first run is kept
+		if err != nil || *id != "abc" {
+			t.Errorf("run %d: id: (want: abc; got: %q, %v)", i, *id, err)
+		}
+		if b, _ := ioutil.ReadFile(cPath); !strings.Contains(string(b), "\nid=abc\n") {
+			t.Errorf("run %d: the seed must be persisted:\n%s", i, b)
+		}
+	}
+
+	fs := flag.NewFlagSet("persist", flag.ContinueOnError)
+	fs.String("id", "", "machine id")
+	err = ApplyAndPersist("confy_persist", map[string]string{"other": "1"}, WithPath(filepath.Join(dir, "new")), WithFlagSet(fs))
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new")); !os.IsNotExist(err) {
+		t.Errorf("nothing must be written for unknown keys")
+	}
+
+	fs = flag.NewFlagSet("persist", flag.ContinueOnError)
+	fs.Int("port", 0, "port")
+	if err := ApplyAndPersist("confy_persist", map[string]string{"port": "x"}, WithPath(cPath), WithFlagSet(fs)); err == nil {
+		t.Errorf("expected an error for an invalid value")
+	}
+}
+
+func TestObsoleteAsError(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_obsolete")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "config")
+	content := "port=4\nold=1\n\n\n# " + obsoleteBanner + "\nolder=2\n"
+	if err := ioutil.WriteFile(cPath, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to create config file")
+	}
+
+	logs := new(bytes.Buffer)
+	fs := flag.NewFlagSet("obsolete", flag.ContinueOnError)
+	fs.Int("port", 3, "port")
+	res, err := ParseDetailed("confy_obsolete", WithPath(cPath), WithFlagSet(fs), WithWriter(logs), WithObsoleteAsError(true))
+	if !errors.Is(err, ErrObsoleteKeys) || !strings.HasSuffix(err.Error(), ": old, older") || len(res.ObsoleteKeys) != 2 {
+		t.Errorf("expected ErrObsoleteKeys, got: %v, %v", res.ObsoleteKeys, err)
+	}
+	if b, _ := ioutil.ReadFile(cPath); string(b) != content || logs.Len() > 0 {
+		t.Errorf("the file must not be written without warning:\n%s\n%s", b, logs)
+	}
+}
+
+func TestDeprecation(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_deprecation")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(cPath, []byte("port=4\n# the address\naddr=:80\nold=1\n"), 0600); err != nil {
+		t.Fatalf("failed to create config file")
+	}
+
+	logs := new(bytes.Buffer)
+	for i := 0; i < 2; i++ {
+		fs := flag.NewFlagSet("deprecation", flag.ContinueOnError)
+		fs.Int("port", 3, "port")
+		if _, err := ParseDetailed("confy_deprecation", WithPath(cPath), WithFlagSet(fs), WithWriter(logs),
+			WithDeprecation("ADDR", "use listen instead")); err != nil {
+			t.Fatalf("unexpected error occurred: %v", err)
+		}
+	}
+	want := `
+# port (int, default 3)
+port=4
+
+
+# The following options are probably deprecated and not used currently!
+# the address
+# use listen instead
+addr=:80
+old=1
+`
+	if b, _ := ioutil.ReadFile(cPath); !strings.HasSuffix(string(b), want) {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, b)
+	}
+	if strings.Count(logs.String(), "addr in "+cPath+" is deprecated: use listen instead") != 2 || strings.Contains(logs.String(), "old in") {
+		t.Errorf("unexpected warnings:\n%s", logs)
 	}
 }
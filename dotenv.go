@@ -0,0 +1,202 @@
+package confy
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DotenvCodec reads and writes config files in the format of .env files, see
+// ParseDotenv.
+var DotenvCodec ConfigCodec = dotenvCodec{}
+
+// ParseDotenv is like Parse but the config file is written like a .env file,
+// e.g. an existing one of the project used with WithPath. Each line holds a
+// KEY=VALUE pair, optionally preceded by export, and lines starting with #
+// are comments. Values may be single quoted, which keeps them as they are,
+// or double quoted, which supports the escape sequences \n, \r, \t, \\, \",
+// and \$. Quoted values may span several lines. $VAR is not expanded. The
+// keys are the names of the environment variables of the flags without the
+// prefix, e.g. LOG_LEVEL for the flag log-level, see Parse. The file is
+// located like the default config file, but with the extension .env. Keys
+// not matching any flag are preserved in the deprecated section at the end.
+func ParseDotenv(appName string) error {
+	return ParseCodec(appName, DotenvCodec)
+}
+
+// dotenvCodec implements DotenvCodec. On its own, it reads and writes the
+// keys as they are, dotenvFormat maps them to the flags.
+type dotenvCodec struct{}
+
+func (dotenvCodec) Extension() string {
+	return ".env"
+}
+
+func (c dotenvCodec) Decode(r io.Reader) (map[string]string, error) {
+	return c.decodeLimited(r, defaultMaxLine)
+}
+
+func (dotenvCodec) decodeLimited(r io.Reader, max int) (map[string]string, error) {
+	values := make(map[string]string)
+	var errs []error
+	lineNum := 0
+	scanner := newLineScanner(r, max)
+	for scanner.Scan() {
+		lineNum++
+		start := lineNum
+		line := scanner.Text()
+		if lineNum == 1 {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if rest := strings.TrimPrefix(line, "export"); rest != line && strings.TrimLeft(rest, " \t") != rest {
+			line = strings.TrimSpace(rest)
+		}
+		i := strings.IndexByte(line, '=')
+		if i == -1 {
+			errs = append(errs, fmt.Errorf("line %d: missing = after key", start))
+			continue
+		}
+		key, text := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+
+		// quoted values continue on the next lines until the closing quote
+		if strings.HasPrefix(text, `"`) || strings.HasPrefix(text, "'") {
+			for !dotenvTerminated(text) && scanner.Scan() {
+				lineNum++
+				text += "\n" + scanner.Text()
+			}
+		}
+		val, err := dotenvValue(text)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", start, err))
+			continue
+		}
+		values[key] = val
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, scanError(err, lineNum, max)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return values, nil
+}
+
+// errUnterminated is reported for quoted values without closing quote.
+var errUnterminated = errors.New("unterminated string")
+
+// dotenvTerminated reports whether the quoted value text contains its closing
+// quote.
+func dotenvTerminated(text string) bool {
+	_, err := dotenvValue(text)
+	return !errors.Is(err, errUnterminated)
+}
+
+// dotenvValue decodes the value text after the =, which may be quoted and
+// followed by a comment.
+func dotenvValue(text string) (string, error) {
+	var val, rest string
+	switch {
+	case strings.HasPrefix(text, "'"):
+		end := strings.Index(text[1:], "'")
+		if end == -1 {
+			return "", fmt.Errorf("%w %s", errUnterminated, text)
+		}
+		val, rest = text[1:end+1], text[end+2:]
+	case strings.HasPrefix(text, `"`):
+		var b strings.Builder
+		i := 1
+		for ; i < len(text) && text[i] != '"'; i++ {
+			if text[i] != '\\' || i+1 == len(text) {
+				b.WriteByte(text[i])
+				continue
+			}
+			i++
+			switch text[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case '\\', '"', '$':
+				b.WriteByte(text[i])
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(text[i])
+			}
+		}
+		if i >= len(text) {
+			return "", fmt.Errorf("%w %s", errUnterminated, text)
+		}
+		val, rest = b.String(), text[i+1:]
+	default:
+		// a comment must be preceded by white space, e.g. COLOR=#fff is kept
+		if i := strings.Index(text, " #"); i != -1 {
+			text = text[:i]
+		} else if i := strings.Index(text, "\t#"); i != -1 {
+			text = text[:i]
+		}
+		return strings.TrimSpace(text), nil
+	}
+	if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", fmt.Errorf("unexpected %s", rest)
+	}
+	return val, nil
+}
+
+func (dotenvCodec) Encode(w io.Writer, flags []flag.Flag, obsolete map[string]string) error {
+	var b strings.Builder
+	for _, f := range flags {
+		fmt.Fprintf(&b, "\n%s\n%s=%s\n", commentLines("#", usageText(&f)), envName("", f.Name), dotenvQuote(valueString(&f)))
+	}
+	if len(obsolete) > 0 {
+		fmt.Fprintf(&b, "\n\n# %s\n", obsoleteBanner)
+		for _, key := range sortedKeys(obsolete) {
+			fmt.Fprintf(&b, "%s=%s\n", key, dotenvQuote(obsolete[key]))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// dotenvQuote double quotes val, unless it only consists of characters
+// without special meaning.
+func dotenvQuote(val string) string {
+	if isPlainValue(val) {
+		return val
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "\n", `\n`, "\r", `\r`, "\t", `\t`).Replace(val) + `"`
+}
+
+// dotenvFormat is a codecFormat for DotenvCodec, which maps the keys to the
+// flags by the names of their environment variables.
+type dotenvFormat struct {
+	codecFormat
+}
+
+func (f dotenvFormat) parse(o *options, r io.Reader) (*config, error) {
+	values, err := f.decode(o, r)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]string)
+	o.fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := keys[envName("", f.Name)]; !ok {
+			keys[envName("", f.Name)] = f.Name
+		}
+	})
+	mapped := make(map[string]string)
+	for key, val := range values {
+		if name, ok := keys[strings.ToUpper(key)]; ok {
+			key = name
+		}
+		mapped[key] = val
+	}
+	return applyDecoded(o, mapped)
+}
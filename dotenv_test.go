@@ -0,0 +1,90 @@
+package confy
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDotenv(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_dotenv")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, ".env")
+	if err := ioutil.WriteFile(cPath, []byte(`# project settings
+export LOG_LEVEL=debug
+PORT = 8080 # the port
+DB_NAME='my app'
+GREETING="hello\n\"world\" \$HOME"
+CERT="line1
+line2"
+COLOR=#fff
+OLD_KEY=1
+`), 0600); err != nil {
+		t.Fatalf("failed to create config file")
+	}
+
+	want := `
+# certificate (string, default )
+CERT="line1\nline2"
+
+# color (string, default )
+COLOR="#fff"
+
+# database name (string, default )
+DB_NAME="my app"
+
+# greeting (string, default )
+GREETING="hello\n\"world\" \$HOME"
+
+# log level (string, default info)
+LOG_LEVEL=debug
+
+# port (int, default 80)
+PORT=8080
+
+
+# The following options are probably deprecated and not used currently!
+OLD_KEY=1
+`
+	for i, wantChanged := range []bool{true, false} {
+		fs := flag.NewFlagSet("dotenv", flag.ContinueOnError)
+		level := fs.String("log-level", "info", "log level")
+		port := fs.Int("port", 80, "port")
+		name := fs.String("db.name", "", "database name")
+		greeting := fs.String("greeting", "", "greeting")
+		cert := fs.String("cert", "", "certificate")
+		color := fs.String("color", "", "color")
+		res, err := ParseDetailed("confy_dotenv", WithPath(cPath), WithFlagSet(fs), WithCodec(DotenvCodec), WithUpdateWarning(false))
+		if err != nil {
+			t.Fatalf("run %d: unexpected error occurred: %v", i, err)
+		}
+		if *level != "debug" || *port != 8080 || *name != "my app" || *greeting != "hello\n\"world\" $HOME" || *cert != "line1\nline2" || *color != "#fff" {
+			t.Errorf("run %d: unexpected values: %q, %d, %q, %q, %q, %q", i, *level, *port, *name, *greeting, *cert, *color)
+		}
+		if res.Changed != wantChanged || res.ObsoleteKeys["OLD_KEY"] != "1" {
+			t.Errorf("run %d: unexpected result: %+v", i, res)
+		}
+		if b, _ := ioutil.ReadFile(cPath); string(b) != want {
+			t.Errorf("run %d: unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", i, want, b)
+		}
+	}
+
+	if _, err := DotenvCodec.Decode(strings.NewReader("A=1\nB=\"open\nC=3\n")); err == nil || !strings.Contains(err.Error(), "line 2: unterminated string") {
+		t.Errorf("expected an error for the unterminated string, got: %v", err)
+	}
+	if _, err := DotenvCodec.Decode(strings.NewReader("A=1\nB\n")); err == nil || err.Error() != "line 2: missing = after key" {
+		t.Errorf("expected an error for the missing =, got: %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package confy
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ExportEnvFile writes the current values of the flags of flag.CommandLine to
+// w as the environment variables read by Parse, e.g. APPNAME_LOG_LEVEL=debug,
+// for the EnvironmentFile= directive of systemd. There are no comments, and
+// values are double quoted if needed. As the values are meant to configure
+// the app, secret flags are written as they are, see WithSecret. The flag set
+// and the prefix of the variables can be customized with opts like
+// ParseWith, see WithFlagSet and WithEnvPrefix.
+func ExportEnvFile(appName string, w io.Writer, opts ...Option) error {
+	if err := checkAppName(appName); err != nil {
+		return err
+	}
+	o := newOptions(appName, opts)
+	cw := &errWriter{w: w}
+	for _, f := range savedFlags(o) {
+		fmt.Fprintf(cw, "%s=%s\n", envName(o.envPrefix, f.Name), envFileValue(valueString(&f)))
+	}
+	return cw.err
+}
+
+// envFileValue quotes val for an EnvironmentFile of systemd, unless it only
+// consists of characters without special meaning. Within double quotes, the
+// backslash escapes \, ", $ and `, while newlines are kept.
+func envFileValue(val string) string {
+	if isPlainValue(val) {
+		return val
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "`", "\\`").Replace(val) + `"`
+}
+
+// isPlainValue reports whether val only consists of characters without special
+// meaning in environment files, so it doesn't need to be quoted.
+func isPlainValue(val string) bool {
+	return strings.IndexFunc(val, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.,:/+@%=", r))
+	}) == -1
+}
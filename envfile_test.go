@@ -0,0 +1,55 @@
+package confy
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"testing"
+)
+
+func TestExportEnvFile(t *testing.T) {
+	fs := flag.NewFlagSet("envfile", flag.ContinueOnError)
+	fs.Int("port", 8080, "port")
+	fs.String("log-level", "debug", "log level")
+	fs.String("db.name", "my app", "database name")
+	fs.String("msg", "say \"hi\" to $USER\\\nbye", "message")
+	fs.String("empty", "", "empty")
+	fs.Duration("timeout", 90e9, "timeout")
+	verbose := fs.Bool("verbose", false, "verbose")
+	fs.BoolVar(verbose, "v", false, "verbose")
+	fs.Set("v", "true")
+
+	buf := new(bytes.Buffer)
+	if err := ExportEnvFile("myapp", buf, WithFlagSet(fs), WithSecret("port")); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	want := `MYAPP_DB_NAME="my app"
+MYAPP_EMPTY=
+MYAPP_LOG_LEVEL=debug
+MYAPP_MSG="say \"hi\" to \$USER\\
+bye"
+MYAPP_PORT=8080
+MYAPP_TIMEOUT=1m30s
+MYAPP_VERBOSE=true
+`
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+	}
+
+	buf.Reset()
+	if err := ExportEnvFile("myapp", buf, WithFlagSet(fs), WithEnvPrefix("SVC_")); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("SVC_DB_NAME=")) {
+		t.Errorf("the prefix must be honored:\n%s", buf)
+	}
+
+	// the app name is checked and made a valid shell variable name
+	buf.Reset()
+	if err := ExportEnvFile("my-app.v2", buf, WithFlagSet(fs)); err != nil || !bytes.HasPrefix(buf.Bytes(), []byte("MY_APP_V2_DB_NAME=")) {
+		t.Errorf("unexpected result: %v\n%s", err, buf)
+	}
+	if err := ExportEnvFile("../app", buf, WithFlagSet(fs)); !errors.Is(err, ErrInvalidAppName) {
+		t.Errorf("expected ErrInvalidAppName, got: %v", err)
+	}
+}
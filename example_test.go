@@ -0,0 +1,69 @@
+package confy_test
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aleks20905/confy"
+)
+
+func ExampleWithValidator() {
+	// simulate running "myapp -log-level=verbose"
+	oldArgs := os.Args
+	os.Args = []string{"myapp", "-log-level=verbose"}
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	fs := flag.NewFlagSet("myapp", flag.ContinueOnError)
+	fs.String("log-level", "info", "one of debug, info, warn or error")
+
+	levels := []string{"debug", "info", "warn", "error"}
+	err := confy.ParseWith("myapp",
+		confy.WithFlagSet(fs),
+		confy.WithPath(filepath.Join(os.TempDir(), "confy_example_validator.ini")),
+		confy.WithDryRun(func([]byte) {}),
+		confy.WithValidator("log-level", func(value string) error {
+			for _, level := range levels {
+				if value == level {
+					return nil
+				}
+			}
+			return fmt.Errorf("must be one of %s", strings.Join(levels, ", "))
+		}),
+	)
+	fmt.Println(err)
+	// Output: invalid value "verbose" for flag log-level: must be one of debug, info, warn, error
+}
+
+func ExampleWithAfterLoad() {
+	// simulate running "myapp -tls -cert=server.pem"
+	oldArgs := os.Args
+	os.Args = []string{"myapp", "-tls", "-cert=server.pem"}
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	fs := flag.NewFlagSet("myapp", flag.ContinueOnError)
+	fs.Bool("tls", false, "serve with TLS")
+	fs.String("cert", "", "certificate file")
+	fs.String("key", "", "key file")
+
+	err := confy.ParseWith("myapp",
+		confy.WithFlagSet(fs),
+		confy.WithPath(filepath.Join(os.TempDir(), "confy_example_afterload.ini")),
+		confy.WithDryRun(func([]byte) {}),
+		confy.WithAfterLoad(func(fs *flag.FlagSet) error {
+			tls := fs.Lookup("tls").Value.(flag.Getter).Get().(bool)
+			if tls && (fs.Lookup("cert").Value.String() == "" || fs.Lookup("key").Value.String() == "") {
+				return fmt.Errorf("-tls requires both -cert and -key")
+			}
+			return nil
+		}),
+	)
+	fmt.Println(err)
+	// Output: -tls requires both -cert and -key
+}
@@ -0,0 +1,44 @@
+package confy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+)
+
+// gzipExt is the extension of config files which are written compressed.
+const gzipExt = ".gz"
+
+// gzipMagic starts gzip compressed data.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decompress returns the decompressed content of r if it starts with the gzip
+// magic bytes, otherwise the content as it is. compressed reports whether the
+// config file at path should be written compressed, which is the case for
+// compressed content and for the extension .gz.
+func decompress(r io.Reader, path string) (_ io.Reader, compressed bool, err error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(gzipMagic)); !bytes.Equal(magic, gzipMagic) {
+		return br, strings.HasSuffix(path, gzipExt), nil
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, false, err
+	}
+	return zr, true, nil
+}
+
+// compress returns content compressed with gzip.
+func compress(content []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(content); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,102 @@
+package confy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGzip(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_gzip")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+
+	gunzip := func(name string) string {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", name, err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%s is not compressed: %v", name, err)
+		}
+		b, err = ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("failed to decompress %s: %v", name, err)
+		}
+		return string(b)
+	}
+
+	// compressed content is detected regardless of the extension
+	cPath := filepath.Join(dir, "config")
+	content, err := compress([]byte("port=4\n"))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if err := ioutil.WriteFile(cPath, content, 0600); err != nil {
+		t.Fatalf("failed to create config file")
+	}
+	for i := 0; i < 2; i++ {
+		fs := flag.NewFlagSet("gzip", flag.ContinueOnError)
+		port := fs.Int("port", 3, "port")
+		res, err := ParseDetailed("confy_gzip", WithPath(cPath), WithFlagSet(fs), WithBackup(true))
+		if err != nil || *port != 4 || res.Changed != (i == 0) {
+			t.Fatalf("run %d: unexpected result: %d, %v, %v", i, *port, res.Changed, err)
+		}
+	}
+	if got := gunzip(cPath); !strings.HasSuffix(got, "\n# port (int, default 3)\nport=4\n") {
+		t.Errorf("unexpected content:\n%s", got)
+	}
+	if got := gunzip(cPath + ".bak"); got != "port=4\n" {
+		t.Errorf("unexpected backup:\n%s", got)
+	}
+
+	// new files with the extension .gz are compressed
+	cPath = filepath.Join(dir, "config.gz")
+	fs := flag.NewFlagSet("gzip", flag.ContinueOnError)
+	fs.Int("port", 3, "port")
+	if err := ParseWith("confy_gzip", WithPath(cPath), WithFlagSet(fs)); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if got := gunzip(cPath); !strings.HasSuffix(got, "\nport=3\n") {
+		t.Errorf("unexpected content:\n%s", got)
+	}
+
+	// other files stay uncompressed
+	cPath = filepath.Join(dir, "plain")
+	fs = flag.NewFlagSet("gzip", flag.ContinueOnError)
+	fs.Int("port", 3, "port")
+	if err := ParseWith("confy_gzip", WithPath(cPath), WithFlagSet(fs)); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(cPath); !strings.HasSuffix(string(b), "\nport=3\n") {
+		t.Errorf("unexpected content:\n%s", b)
+	}
+
+	// corrupt files are not overwritten
+	cPath = filepath.Join(dir, "corrupt")
+	if err := ioutil.WriteFile(cPath, content[:len(content)-4], 0600); err != nil {
+		t.Fatalf("failed to create config file")
+	}
+	fs = flag.NewFlagSet("gzip", flag.ContinueOnError)
+	fs.Int("port", 3, "port")
+	if err := ParseWith("confy_gzip", WithPath(cPath), WithFlagSet(fs)); err == nil {
+		t.Errorf("expected an error for the truncated file")
+	}
+	if b, _ := ioutil.ReadFile(cPath); !bytes.Equal(b, content[:len(content)-4]) {
+		t.Errorf("the corrupt file must not be written")
+	}
+}
@@ -0,0 +1,130 @@
+package confy
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// jsonDeprecated is the key of the object holding the obsolete keys in JSON
+// config files.
+const jsonDeprecated = "_deprecated"
+
+// ParseJSON is like Parse but the config file is a flat JSON object mapping
+// flag names to their values, e.g. {"port": 8080, "host": "localhost"}. It is
+// located like the default config file, but with the extension .json. Keys
+// not matching any flag are preserved in the nested object "_deprecated".
+func ParseJSON(appName string) error {
+	return ParseCodec(appName, jsonCodec{})
+}
+
+// jsonCodec reads and writes config files as JSON objects.
+type jsonCodec struct{}
+
+func (jsonCodec) Extension() string {
+	return ".json"
+}
+
+func (c jsonCodec) Decode(r io.Reader) (map[string]string, error) {
+	return c.decodeLimited(r, defaultMaxLine)
+}
+
+func (jsonCodec) decodeLimited(r io.Reader, max int) (map[string]string, error) {
+	// read the file line by line to enforce the limit, line endings are
+	// whitespace outside of JSON strings, which can't contain them
+	var data []byte
+	lineNum := 0
+	scanner := newLineScanner(r, max)
+	for scanner.Scan() {
+		lineNum++
+		data = append(append(data, scanner.Bytes()...), '\n')
+	}
+	err := scanner.Err()
+	if err != nil {
+		return nil, scanError(err, lineNum, max)
+	}
+	values := make(map[string]string)
+	if len(bytes.TrimSpace(data)) == 0 {
+		return values, nil
+	}
+
+	var obj map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil {
+		return nil, err
+	}
+	deprecated := make(map[string]string)
+	if dep, ok := obj[jsonDeprecated]; ok {
+		depObj, ok := dep.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s must be an object", jsonDeprecated)
+		}
+		for key, val := range depObj {
+			if deprecated[key], err = jsonString(key, val); err != nil {
+				return nil, err
+			}
+		}
+		delete(obj, jsonDeprecated)
+	}
+	for key, val := range obj {
+		if values[key], err = jsonString(key, val); err != nil {
+			return nil, err
+		}
+	}
+	return withDeprecated(values, deprecated), nil
+}
+
+// jsonString converts the JSON value val of key to the string form accepted
+// by flag.Value.Set.
+func jsonString(key string, val interface{}) (string, error) {
+	switch val := val.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return val, nil
+	case json.Number:
+		return val.String(), nil
+	case bool:
+		return strconv.FormatBool(val), nil
+	}
+	return "", fmt.Errorf("unsupported value for %s, only strings, numbers, booleans and null are allowed", key)
+}
+
+func (jsonCodec) Encode(w io.Writer, flags []flag.Flag, obsolete map[string]string) error {
+	var entries []string
+	for _, f := range flags {
+		entries = append(entries, fmt.Sprintf("  %s: %s", jsonMarshal(f.Name), jsonMarshal(typedValue(&f))))
+	}
+
+	if len(obsolete) > 0 {
+		var deprecated []string
+		for _, key := range sortedKeys(obsolete) {
+			deprecated = append(deprecated, fmt.Sprintf("    %s: %s", jsonMarshal(key), jsonMarshal(obsolete[key])))
+		}
+		entries = append(entries, fmt.Sprintf("  %q: {\n%s\n  }", jsonDeprecated, strings.Join(deprecated, ",\n")))
+	}
+
+	if len(entries) == 0 {
+		_, err := fmt.Fprintln(w, "{}")
+		return err
+	}
+	_, err := fmt.Fprintf(w, "{\n%s\n}\n", strings.Join(entries, ",\n"))
+	return err
+}
+
+// jsonMarshal encodes v as JSON without escaping HTML characters. Values that
+// cannot be encoded, like infinite floats, are encoded as strings.
+func jsonMarshal(v interface{}) string {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return jsonMarshal(fmt.Sprint(v))
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -0,0 +1,78 @@
+package confy
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseJSON(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	f, err := ioutil.TempFile("", "confy_testjson")
+	if err != nil {
+		t.Fatalf("failed to create tempfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"port": 8080, "host": "localhost", "Verbose": true, "old": 1, "_deprecated": {"older": "x", "timeout": "5s"}}`)
+	f.Close()
+	os.Setenv("CONFY_JSONINF0", f.Name())
+	defer os.Unsetenv("CONFY_JSONINF0")
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	port := flag.Int("port", 80, "port")
+	host := flag.String("host", "", "host <name>")
+	verbose := flag.Bool("verbose", false, "verbose")
+	timeout := flag.Duration("timeout", time.Second, "timeout")
+	ratio := flag.Float64("ratio", 0.5, "ratio")
+	if err := ParseWith("confy_json", WithCodec(jsonCodec{}), WithUpdateWarning(false)); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *port != 8080 || *host != "localhost" || !*verbose || *timeout != 5*time.Second || *ratio != 0.5 {
+		t.Errorf("unexpected values: %d, %q, %v, %v, %v", *port, *host, *verbose, *timeout, *ratio)
+	}
+
+	want := `{
+  "host": "localhost",
+  "port": 8080,
+  "ratio": 0.5,
+  "timeout": "5s",
+  "verbose": true,
+  "_deprecated": {
+    "old": "1",
+    "older": "x"
+  }
+}
+`
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil || string(b) != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, b)
+	}
+
+	// the rewritten file is stable
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flag.Int("port", 80, "port")
+	flag.String("host", "", "host <name>")
+	flag.Bool("verbose", false, "verbose")
+	flag.Duration("timeout", time.Second, "timeout")
+	flag.Float64("ratio", 0.5, "ratio")
+	res, err := ParseDetailed("confy_json", WithCodec(jsonCodec{}), WithUpdateWarning(false))
+	if err != nil || res.Changed {
+		t.Errorf("unexpected rewrite: %v, %v", res.Changed, err)
+	}
+
+	if err := ioutil.WriteFile(f.Name(), []byte(`{"port": [1]}`), 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", f.Name(), err)
+	}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flag.Int("port", 80, "port")
+	if err := ParseJSON("confy_json"); err == nil {
+		t.Errorf("expected an error for an array value")
+	}
+}
@@ -0,0 +1,69 @@
+package confy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// lockRetry is the interval in which lockFile tries to acquire a held lock.
+var lockRetry = 20 * time.Millisecond
+
+// ErrLocked is reported if the lock of the config file could not be acquired
+// within the timeout, see WithFileLock.
+var ErrLocked = errors.New("config file is locked")
+
+// lockFile acquires the advisory lock of the config file at path, which is
+// held on the file path.lock, as the config file itself is replaced when it
+// is written. The lock file is never removed, as that would allow another
+// process to lock a new file while the old one is still locked. It waits up
+// to timeout for other processes to release the lock. If the directory of
+// path doesn't exist, there is nothing to lock.
+func lockFile(ctx context.Context, path string, timeout time.Duration) (unlock func(), err error) {
+	name := path + ".lock"
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if errors.Is(err, os.ErrNotExist) {
+		return func() {}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to open lock file %s: %w", name, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		locked, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("unable to lock %s: %w", name, err)
+		} else if locked {
+			return func() {
+				unlockFile(f)
+				f.Close()
+			}, nil
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			f.Close()
+			return nil, fmt.Errorf("%w: %s is held by another process for more than %v", ErrLocked, name, timeout)
+		} else if wait > lockRetry {
+			wait = lockRetry
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// lockConfig acquires the lock of the config file at path if enabled, see
+// WithFileLock.
+func (o *options) lockConfig(path string) (unlock func(), err error) {
+	if !o.lock || o.opener != nil {
+		return func() {}, nil
+	}
+	return lockFile(o.ctx, path, o.lockWait)
+}
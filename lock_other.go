@@ -0,0 +1,18 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package confy
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// tryLock reports an error, as file locking is not supported on this platform.
+func tryLock(f *os.File) (bool, error) {
+	return false, fmt.Errorf("file locking is not supported on %s", runtime.GOOS)
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
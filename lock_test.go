@@ -0,0 +1,70 @@
+package confy
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLock(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_lock")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "config")
+
+	unlock, err := lockFile(context.Background(), cPath, 0)
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	fs := flag.NewFlagSet("lock", flag.ContinueOnError)
+	fs.Int("port", 3, "port")
+	err = ParseWith("confy_lock", WithPath(cPath), WithFlagSet(fs), WithFileLock(50*time.Millisecond))
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("expected ErrLocked, got: %v", err)
+	}
+	if _, err := os.Stat(cPath); !os.IsNotExist(err) {
+		t.Errorf("the config file must not be created without the lock")
+	}
+
+	// the lock is acquired as soon as it is released
+	done := make(chan struct{})
+	go func(unlock func()) {
+		defer close(done)
+		time.Sleep(20 * time.Millisecond)
+		unlock()
+	}(unlock)
+	fs = flag.NewFlagSet("lock", flag.ContinueOnError)
+	fs.Int("port", 3, "port")
+	if err := ParseWith("confy_lock", WithPath(cPath), WithFlagSet(fs), WithFileLock(time.Minute)); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	<-done
+	if _, err := os.Stat(cPath); err != nil {
+		t.Errorf("the config file must be created: %v", err)
+	}
+
+	// the lock is released after parsing
+	unlock2, err := lockFile(context.Background(), cPath, 0)
+	if err != nil {
+		t.Fatalf("the lock must be released: %v", err)
+	}
+	unlock2()
+
+	// without a directory there is nothing to lock
+	if _, err := lockFile(context.Background(), filepath.Join(dir, "missing", "config"), 0); err != nil {
+		t.Errorf("unexpected error occurred: %v", err)
+	}
+}
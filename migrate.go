@@ -0,0 +1,149 @@
+package confy
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// versionKey is the key holding the version of the config file, see
+// WithMigration.
+const versionKey = "confy_version"
+
+// versionUsage describes the version key in formats requiring a usage.
+const versionUsage = "version of the config file, do not change"
+
+// WithMigration registers fn to migrate the keys and values of config files
+// from version from to version from+1, e.g. to rename or restructure keys.
+// The current version is one more than the highest version with a registered
+// migration.
+//
+// Config files store their version in the key confy_version, files without it
+// have version 0. When a file of an older version is read, the migrations of
+// all versions from its version on are run in order on its keys and values
+// before they are applied to the flags. Keys of sections are passed with their
+// dotted prefix, e.g. db.host. The file is then written with the current
+// version, keeping the comments of all keys not changed by the migrations.
+// Files of a newer version are applied as they are, with a warning.
+func WithMigration(from int, fn func(values map[string]string) map[string]string) Option {
+	return func(o *options) {
+		if o.migrations == nil {
+			o.migrations = make(map[int]func(map[string]string) map[string]string)
+		}
+		o.migrations[from] = fn
+	}
+}
+
+// currentVersion returns the version of config files written by o.
+func (o *options) currentVersion() int {
+	v := 0
+	for from := range o.migrations {
+		if from+1 > v {
+			v = from + 1
+		}
+	}
+	return v
+}
+
+// fileVersion returns the version to write for conf, which is the current
+// version unless conf was read from a newer file.
+func (o *options) fileVersion(conf *config) int {
+	if v := o.currentVersion(); v > conf.version {
+		return v
+	}
+	return conf.version
+}
+
+// migrate runs the migrations from version onwards on values.
+func (o *options) migrate(values map[string]string, version int) map[string]string {
+	if version > o.currentVersion() {
+		o.log.Printf("WARNING: %s has version %d, which is newer than the supported version %d\n", o.path, version, o.currentVersion())
+		return values
+	}
+	for v := version; v < o.currentVersion(); v++ {
+		if fn, ok := o.migrations[v]; ok {
+			if values = fn(values); values == nil {
+				values = make(map[string]string)
+			}
+		}
+	}
+	return values
+}
+
+// migrateValues removes the version key from values read by a codec and
+// migrates them, returning the version of the file and the migrated values.
+func migrateValues(o *options, values map[string]string) (int, map[string]string, error) {
+	version := 0
+	for key, val := range values {
+		if !strings.EqualFold(key, versionKey) || o.fs.Lookup(key) != nil {
+			continue
+		}
+		var err error
+		if version, err = strconv.Atoi(val); err != nil {
+			return 0, nil, fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+		delete(values, key)
+	}
+	return version, o.migrate(values, version), nil
+}
+
+// parseMigrated is like parseConfig but migrates the config file first, see
+// WithMigration. The file is parsed as usual except for the keys changed or
+// removed by the migrations, the values of the changed and added keys are
+// applied afterwards like by a codec.
+func parseMigrated(o *options, r io.Reader) (*config, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// read the keys and values without applying them to the flags, any
+	// errors are reported by parsing the file for real
+	neutral := *o
+	neutral.fs = flag.NewFlagSet("", flag.ContinueOnError)
+	neutral.log = writerLogger{io.Discard}
+	neutral.strict, neutral.aliases = false, nil
+	old, err := parseConfig(&neutral, bytes.NewReader(data))
+	if err != nil || old.version == o.currentVersion() {
+		return parseConfig(o, bytes.NewReader(data))
+	}
+	values := make(map[string]string)
+	for key, val := range old.obsolete {
+		values[key] = val
+	}
+	migrated := o.migrate(values, old.version)
+
+	names := make(map[string]string)
+	o.fs.VisitAll(func(f *flag.Flag) {
+		names[strings.ToLower(f.Name)] = f.Name
+	})
+	skip := make(map[string]bool)
+	for key, val := range old.obsolete {
+		if v, ok := migrated[key]; !ok || v != val {
+			skip[resolveKey(o, names, "", key)] = true
+		}
+	}
+	changed := make(map[string]string)
+	for key, val := range migrated {
+		if v, ok := old.obsolete[key]; !ok || v != val {
+			changed[key] = val
+		}
+	}
+
+	conf, err := parseConfigFile(o, bytes.NewReader(data), rootIncludes(o), skip)
+	if err != nil {
+		return conf, err
+	}
+	applied, err := applyValues(o, changed)
+	for key, val := range applied.obsolete {
+		conf.obsolete[key] = val
+	}
+	for name, raw := range applied.raw {
+		raw.text = o.formatValue(raw.text)
+		conf.raw[name] = raw
+	}
+	return conf, err
+}
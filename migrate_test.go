@@ -0,0 +1,147 @@
+package confy
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMigration(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	listen := flag.String("listen", "", "listen address")
+	name := flag.String("db.name", "", "database name")
+	port := flag.Int("port", 0, "port")
+
+	var calls []int
+	logs := new(bytes.Buffer)
+	o := newOptions("confy_test", []Option{
+		WithWriter(logs),
+		WithMigration(0, func(values map[string]string) map[string]string {
+			calls = append(calls, 0)
+			values["listen"] = values["addr"]
+			delete(values, "addr")
+			return values
+		}),
+		WithMigration(1, func(values map[string]string) map[string]string {
+			calls = append(calls, 1)
+			values["db.name"] = strings.ToUpper(values["db.name"])
+			return values
+		}),
+	})
+	conf, err := o.format.parse(o, bytes.NewBufferString(`
+# old address
+addr=:80
+
+# the port
+port=8080
+old=1
+
+[db]
+name=app`))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *listen != ":80" || *name != "APP" || *port != 8080 {
+		t.Errorf("unexpected values: %q, %q, %d", *listen, *name, *port)
+	}
+	if fmt.Sprint(calls) != "[0 1]" {
+		t.Errorf("expected the migrations to run in order, got: %v", calls)
+	}
+
+	// the comments and the order of unchanged keys are kept
+	want := `
+confy_version=2
+
+# the port
+# port (int, default 0)
+port=8080
+
+# listen address (string, default )
+listen=:80
+
+[db]
+
+# database name (string, default )
+name=APP
+
+
+# The following options are probably deprecated and not used currently!
+[]
+old=1
+`
+	resWriter := new(bytes.Buffer)
+	if err := o.format.save(o, resWriter, conf); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	got := resWriter.String()
+	if i := strings.Index(got, "\nconfy_version"); i == -1 || got[i:] != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+	}
+
+	// files of the current version are not migrated again
+	calls = nil
+	if conf, err = o.format.parse(o, bytes.NewBufferString(got)); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	resWriter = new(bytes.Buffer)
+	o.format.save(o, resWriter, conf)
+	if len(calls) > 0 || resWriter.String() != got {
+		t.Errorf("unexpected migration %v:\n%s", calls, resWriter.String())
+	}
+
+	// files of newer versions are applied as they are
+	if conf, err = o.format.parse(o, bytes.NewBufferString("confy_version=5\naddr=:90\n")); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if len(calls) > 0 || conf.obsolete["addr"] != ":90" || !strings.Contains(logs.String(), "version 5, which is newer") {
+		t.Errorf("unexpected result: %v, %v\n%s", calls, conf.obsolete, logs)
+	}
+	resWriter = new(bytes.Buffer)
+	saveConfig(o, resWriter, conf)
+	if !strings.HasPrefix(resWriter.String(), "\nconfy_version=5\n") {
+		t.Errorf("the version must be kept:\n%s", resWriter.String())
+	}
+
+	if _, err := o.format.parse(o, bytes.NewBufferString("confy_version=x\n")); err == nil {
+		t.Errorf("expected an error for an invalid version")
+	}
+}
+
+func TestMigrationCodec(t *testing.T) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	listen := flag.String("listen", "", "listen address")
+
+	o := newOptions("confy_test", []Option{
+		WithCodec(jsonCodec{}),
+		WithMigration(0, func(values map[string]string) map[string]string {
+			return map[string]string{"listen": values["addr"]}
+		}),
+	})
+	conf, err := o.format.parse(o, strings.NewReader(`{"addr": ":80"}`))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *listen != ":80" || len(conf.obsolete) > 0 {
+		t.Errorf("unexpected result: %q, %v", *listen, conf.obsolete)
+	}
+	want := `{
+  "confy_version": "1",
+  "listen": ":80"
+}
+`
+	resWriter := new(bytes.Buffer)
+	if err := o.format.save(o, resWriter, conf); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if got := resWriter.String(); got != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, got)
+	}
+
+	*listen = ""
+	if _, err := o.format.parse(o, strings.NewReader(want)); err != nil || *listen != ":80" {
+		t.Errorf("listen: (want: %q; got: %q, %v)", ":80", *listen, err)
+	}
+}
@@ -0,0 +1,724 @@
+package confy
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Option configures the behaviour of ParseWith.
+type Option func(*options)
+
+type options struct {
+	appName string
+	fs      *flag.FlagSet
+	log     Logger
+	ctx     context.Context
+	force   bool
+	seeds   map[string]string
+	noArgs  bool // the command line is not parsed, see LoadInto
+
+	// config file handling
+	path      string
+	envVar    string
+	baseFiles []string
+	inherited map[string]bool
+	fileMode  os.FileMode
+	warnMode  bool
+	insecure  os.FileMode // rejected permission bits
+	backup    bool
+	dryRun    func([]byte)
+	readOnly  bool
+	create    bool
+	diffSink  func(oldContent, newContent []byte)
+	keysOnly  bool // ignore changes of comments
+	opener    func(path string, flag int, perm os.FileMode) (io.ReadWriteSeeker, error)
+	lock      bool
+	lockWait  time.Duration
+
+	// config file format
+	format        fileFormat
+	header        *string
+	comment       string
+	commentPrefix string
+	separator     byte
+	deprecated    DeprecatedPlacement
+	commentObs    bool // write obsolete keys commented out
+	keyStyle      KeyStyle
+	wrap          int
+	maxLine       int
+	omitDefaults  bool
+	secrets       map[string]bool
+	lists         map[string]string
+	categories    map[string]int // position in categoryOrder plus one
+	categoryOrder []string
+
+	// applying values
+	strict     bool
+	noObsolete bool
+	strictEnv  bool
+	envPrefix  string
+	required   []string
+	validators []validator
+	afterLoad  []func(*flag.FlagSet) error
+	aliases    map[string]string
+	removed    map[string]string // messages of obsolete keys by lower case key
+	unset      string
+	profile    string
+	migrations map[int]func(map[string]string) map[string]string
+
+	updateWarning     bool
+	updateWarningText string
+}
+
+func newOptions(appName string, opts []Option) *options {
+	o := &options{
+		appName:       appName,
+		fs:            flag.CommandLine,
+		format:        textFormat{},
+		log:           writerLogger{os.Stderr},
+		ctx:           context.Background(),
+		fileMode:      0600,
+		commentPrefix: "#",
+		envPrefix:     envKey(appName) + "_",
+		envVar:        envKey(appName) + "INF0",
+		updateWarning: true,
+		create:        true,
+		unset:         "!unset",
+		maxLine:       defaultMaxLine,
+
+		updateWarningText: updateWarning,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithPath uses the config file at path instead of the default location. A
+// path of "-" reads the config from os.Stdin without writing it, see
+// ParseFile. Config files compressed with gzip are decompressed when read and
+// compressed again when written, as are new files with the extension .gz.
+func WithPath(path string) Option {
+	return func(o *options) {
+		o.path = path
+	}
+}
+
+// WithFlagSet operates on fs instead of flag.CommandLine.
+func WithFlagSet(fs *flag.FlagSet) Option {
+	return func(o *options) {
+		o.fs = fs
+	}
+}
+
+// WithForce parses the flags again, even if they have been parsed already,
+// so tests and interactive tools can read the config file once more. It only
+// applies to flag sets passed by WithFlagSet, flag.CommandLine is never
+// parsed twice.
+//
+// Beware that parsing again doesn't reset the flags: flags removed from the
+// config file and flags set on the command line before keep their values, and
+// repeatable flags like lists accumulate the values of all runs. Pass a fresh
+// flag set instead wherever possible.
+func WithForce(force bool) Option {
+	return func(o *options) {
+		o.force = force
+	}
+}
+
+// Logger receives warnings and other diagnostic output. It is satisfied by
+// *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// writerLogger is a Logger writing the messages to an io.Writer unchanged.
+type writerLogger struct {
+	w io.Writer
+}
+
+func (l writerLogger) Printf(format string, v ...interface{}) {
+	fmt.Fprintf(l.w, format, v...)
+}
+
+// WithWriter writes warnings and other diagnostic output to w instead of
+// os.Stderr.
+func WithWriter(w io.Writer) Option {
+	return func(o *options) {
+		o.log = writerLogger{w}
+	}
+}
+
+// WithLogger sends warnings and other diagnostic output to l instead of
+// writing them to os.Stderr.
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		o.log = l
+	}
+}
+
+// WithComment adds text as an additional comment paragraph to the header of
+// the config file. Multiple lines are commented out line by line.
+func WithComment(text string) Option {
+	return func(o *options) {
+		o.comment = text
+	}
+}
+
+// WithHeader replaces the default header of the config file explaining its
+// syntax with text, e.g. a link to the documentation. Lines of text not
+// starting with the comment prefix are commented out. An empty text omits the
+// header.
+func WithHeader(text string) Option {
+	return func(o *options) {
+		o.header = &text
+	}
+}
+
+// WithWrap breaks lines longer than width columns in the written config file
+// using backslash continuation. A width of 0 disables wrapping (the default).
+func WithWrap(width int) Option {
+	return func(o *options) {
+		o.wrap = width
+	}
+}
+
+// WithStrictEnv makes references to unset environment variables in config
+// values an error instead of expanding them to the empty string.
+func WithStrictEnv(strict bool) Option {
+	return func(o *options) {
+		o.strictEnv = strict
+	}
+}
+
+// WithEnvPrefix sets the prefix of the environment variables overriding the
+// values from the config file, which defaults to the upper case appName and
+// an underscore, with characters invalid in shell variables replaced by
+// underscores, see Parse. An empty prefix disables the environment variables.
+func WithEnvPrefix(prefix string) Option {
+	return func(o *options) {
+		o.envPrefix = prefix
+	}
+}
+
+// WithStrict makes keys in the config file not matching any flag an error
+// instead of preserving them in the deprecated section, as well as lines
+// without separator, which are skipped otherwise, see ErrMalformedLine.
+func WithStrict(strict bool) Option {
+	return func(o *options) {
+		o.strict = strict
+	}
+}
+
+// WithObsoleteAsError makes Parse fail with ErrObsoleteKeys listing the keys
+// of the deprecated section, e.g. to fail a CI pipeline on deprecations,
+// instead of warning about them. In contrast to WithStrict, all keys are
+// reported at once, including those of the deprecated section, and the
+// config file is not written until they are removed.
+func WithObsoleteAsError(fail bool) Option {
+	return func(o *options) {
+		o.noObsolete = fail
+	}
+}
+
+// WithRequired makes Parse fail unless the flags with the given names were
+// set to a value other than their default, in the config file, by an
+// environment variable or on the command line. All missing flags are reported
+// together.
+func WithRequired(names ...string) Option {
+	return func(o *options) {
+		o.required = append(o.required, names...)
+	}
+}
+
+// WithProfile selects the profile name of the config file. Profiles are
+// sections named "profile:" followed by the name, e.g. [profile:dev], which
+// end at the next section like any other. The keys of the selected profile
+// are applied after all other keys of the config file, so they take
+// precedence over the keys shared by all profiles, regardless of their
+// position. Environment variables and the command line still take precedence
+// over both. Profiles are never rewritten, even the keys of the selected one
+// are preserved as written, and profiles which are not selected are not
+// applied at all. Only the profiles of the config file itself are supported,
+// not those of included or base files.
+func WithProfile(name string) Option {
+	return func(o *options) {
+		o.profile = name
+	}
+}
+
+// WithAlias applies the value of the key oldKey in the config file to the
+// flag newKey, e.g. after renaming the flag. oldKey is matched
+// case-insensitively like the flags and is not treated as obsolete, unless a
+// flag of that name exists. The file is rewritten with newKey instead of
+// oldKey, so renaming a flag does not break existing config files.
+//
+// WithAlias may be used several times for the same flag to accept different
+// spellings, e.g. both colour and color. If a file sets a flag to different
+// values using different spellings, the last one wins with a warning.
+func WithAlias(oldKey, newKey string) Option {
+	return func(o *options) {
+		if o.aliases == nil {
+			o.aliases = make(map[string]string)
+		}
+		o.aliases[strings.ToLower(oldKey)] = newKey
+	}
+}
+
+// WithDeprecation warns with message about the obsolete key in the config
+// file, e.g. "use listen-address instead", in addition to the general update
+// warning, see WithUpdateWarning. The message is written as comment above the
+// key in the deprecated section as well. key is matched case-insensitively
+// like the flags, including its section, but only if no flag of that name
+// exists.
+func WithDeprecation(key, message string) Option {
+	return func(o *options) {
+		if o.removed == nil {
+			o.removed = make(map[string]string)
+		}
+		o.removed[strings.ToLower(key)] = message
+	}
+}
+
+// deprecationComment returns the comment lines of the deprecation message of
+// the obsolete key, if any.
+func (o *options) deprecationComment(key string) []string {
+	msg, ok := o.removed[strings.ToLower(key)]
+	if !ok {
+		return nil
+	}
+	return strings.Split(commentLines(o.commentPrefix, msg), "\n")
+}
+
+// validator checks the value of the flag name, see WithValidator.
+type validator struct {
+	name string
+	fn   func(string) error
+}
+
+// WithValidator checks the value of the flag name with fn once all values were
+// applied, whether the value comes from the config file, an environment
+// variable, the command line or the default. If fn returns an error, Parse
+// fails with the error, the flag and its value.
+func WithValidator(name string, fn func(value string) error) Option {
+	return func(o *options) {
+		o.validators = append(o.validators, validator{name, fn})
+	}
+}
+
+// WithAfterLoad calls fn with the flag set once all values were applied and
+// checked, after parsing the command line, e.g. to check flags depending on
+// each other or to derive values. If fn returns an error, Parse fails with
+// it. Several functions are called in the order they were added, until one
+// fails. Watch and ReloadOnSignalWith call fn after each reload as well.
+func WithAfterLoad(fn func(fs *flag.FlagSet) error) Option {
+	return func(o *options) {
+		o.afterLoad = append(o.afterLoad, fn)
+	}
+}
+
+// WithFileMode sets the permissions for creating and rewriting the config
+// file, which default to 0600 as config files may contain secrets. Rewriting
+// the file keeps its existing permissions, as long as they don't exceed mode.
+// A warning is written if the existing file has broader permissions.
+func WithFileMode(mode os.FileMode) Option {
+	return func(o *options) {
+		o.fileMode = mode.Perm()
+		o.warnMode = true
+	}
+}
+
+// WithRejectInsecurePermissions reports ErrInsecurePermissions instead of
+// reading the config file if it is writable by its group or by other users,
+// like ssh refuses insecure config files. The same applies to included files,
+// base files and the file of obsolete keys. This is not checked on Windows,
+// where permissions are not represented by the file mode. To reject read
+// access by others as well, see WithRejectReadableByOthers, to only be warned
+// about it, see WithFileMode.
+func WithRejectInsecurePermissions(reject bool) Option {
+	return func(o *options) {
+		o.insecure = rejectBits(o.insecure, 0022, reject)
+	}
+}
+
+// WithRejectReadableByOthers reports ErrInsecurePermissions instead of reading
+// the config file if it is readable by its group or by other users, e.g. for
+// files containing secrets. Like WithRejectInsecurePermissions, this is not
+// checked on Windows.
+func WithRejectReadableByOthers(reject bool) Option {
+	return func(o *options) {
+		o.insecure = rejectBits(o.insecure, 0044, reject)
+	}
+}
+
+// rejectBits adds bits to the rejected permissions if reject is set, otherwise
+// it removes them.
+func rejectBits(rejected, bits os.FileMode, reject bool) os.FileMode {
+	if reject {
+		return rejected | bits
+	}
+	return rejected &^ bits
+}
+
+// WithBackup saves the previous content of the config file to a file with the
+// additional extension .bak whenever the config file is rewritten.
+func WithBackup(backup bool) Option {
+	return func(o *options) {
+		o.backup = backup
+	}
+}
+
+// WithDryRun never writes the config file. Instead, the content that would be
+// written to the file is passed to fn, whether it differs from the existing
+// file or not. A missing config file is not created.
+func WithDryRun(fn func(content []byte)) Option {
+	return func(o *options) {
+		o.dryRun = fn
+	}
+}
+
+// WithDiffSink calls fn with the previous and the new content of the config
+// file whenever the file is about to be rewritten, e.g. to log a diff of the
+// changes. fn is not called if the content did not change or if the file is
+// not written at all, see WithDryRun and WithReadOnly.
+func WithDiffSink(fn func(oldContent, newContent []byte)) Option {
+	return func(o *options) {
+		o.diffSink = fn
+	}
+}
+
+// WithIgnoreCommentChanges only rewrites the config file if its keys and
+// values changed, while changes of the comments alone, e.g. updated usage
+// texts of the flags, and of blank lines are ignored. Lines starting with the
+// comment prefix are considered comments, see WithCommentPrefix.
+func WithIgnoreCommentChanges(ignore bool) Option {
+	return func(o *options) {
+		o.keysOnly = ignore
+	}
+}
+
+// WithCreateOnFirstRun controls whether a missing config file is created with
+// the defaults, which is the default. If create is false, a missing file is
+// treated like an empty one without being created, so nothing is written
+// until the user creates the file, even an empty one. Existing files are
+// still updated. This applies to files located by the environment variable
+// as well, see WithEnvVarName.
+func WithCreateOnFirstRun(create bool) Option {
+	return func(o *options) {
+		o.create = create
+	}
+}
+
+// WithOpener opens the config files with fn instead of os.OpenFile, e.g. to
+// keep them in memory for tests or in another store. fn is called with the
+// flags and permissions of os.OpenFile and must report missing files with
+// an error matching os.ErrNotExist. Files are closed if they implement
+// io.Closer. Instead of being replaced atomically, they are opened again with
+// os.O_TRUNC and written. Permissions are only checked for files implementing
+// Stat() (os.FileInfo, error). No directories are created for them and Watch
+// still polls the file system.
+func WithOpener(fn func(path string, flag int, perm os.FileMode) (io.ReadWriteSeeker, error)) Option {
+	return func(o *options) {
+		o.opener = fn
+	}
+}
+
+// WithFileLock holds an advisory lock while the config file is read and
+// written, so concurrent processes of the same app don't lose each other's
+// changes. The lock is held on the file with the additional extension .lock,
+// which is flock(2) locked on Linux, macOS and the BSDs and with LockFileEx on
+// Windows. On other platforms, like Solaris, locking fails with an error
+// instead of silently not locking. If another process holds the lock for more
+// than timeout, ErrLocked is reported. Files which are never written and
+// those of a custom opener are not locked, see WithOpener.
+func WithFileLock(timeout time.Duration) Option {
+	return func(o *options) {
+		o.lock = true
+		o.lockWait = timeout
+	}
+}
+
+// WithReadOnly only reads the config file and never writes it, see
+// ParseReadOnly.
+func WithReadOnly(readOnly bool) Option {
+	return func(o *options) {
+		o.readOnly = readOnly
+	}
+}
+
+// WithUpdateWarning enables or disables the warning about obsolete keys in
+// the config file. The obsolete keys are preserved in the file either way.
+func WithUpdateWarning(enabled bool) Option {
+	return func(o *options) {
+		o.updateWarning = enabled
+	}
+}
+
+// WithUpdateWarningText replaces the warning about obsolete keys in the config
+// file. The appName and the path of the config file can be included in text
+// with %[1]s and %[2]s, any other % must be escaped as %%.
+func WithUpdateWarningText(text string) Option {
+	return func(o *options) {
+		o.updateWarningText = text
+	}
+}
+
+// WithEnvVarName sets the environment variable pointing to the config file,
+// which defaults to the upper case appName followed by INF0, with characters
+// invalid in shell variables replaced by underscores, e.g. MY_APPINF0 for the
+// app my-app.
+func WithEnvVarName(name string) Option {
+	return func(o *options) {
+		o.envVar = name
+	}
+}
+
+// WithUnsetMarker uses marker instead of !unset as the value resetting a flag
+// to its default, e.g. "port=!unset" undoes the port set by a base file, see
+// ParseFiles, or by an earlier line. The marker is matched as written, so a
+// quoted "!unset" is a regular value. It doesn't apply to lists, see WithList,
+// as their values collect the elements. An empty marker disables resetting.
+func WithUnsetMarker(marker string) Option {
+	return func(o *options) {
+		o.unset = marker
+	}
+}
+
+// WithCommentPrefix uses prefix instead of # to start comments, both when
+// reading the config file, including trailing comments on value lines, and
+// for the comments written to the file. Trailing comments must be preceded by
+// whitespace, e.g. color=#fff sets color to #fff. An empty prefix is ignored.
+// Lines starting with ; are read as comments regardless, as in INI files, but
+// ; doesn't start trailing comments.
+func WithCommentPrefix(prefix string) Option {
+	return func(o *options) {
+		if prefix != "" {
+			o.commentPrefix = prefix
+		}
+	}
+}
+
+// WithSeparator only accepts sep between keys and values when reading the
+// config file and uses it when writing the file. By default, both = and :
+// are accepted, with = taking precedence, and = is written.
+func WithSeparator(sep byte) Option {
+	return func(o *options) {
+		o.separator = sep
+	}
+}
+
+// KeyStyle is the spelling of the keys written to the config file, see
+// WithKeyStyle.
+type KeyStyle int
+
+const (
+	// KeyDash writes the keys like the flag names, e.g. log-level, which is
+	// the default.
+	KeyDash KeyStyle = iota
+	// KeyUnderscore writes the dashes of the flag names as underscores, e.g.
+	// log_level.
+	KeyUnderscore
+)
+
+// WithKeyStyle writes the keys and sections of the config file in style s.
+// When reading, dashes and underscores are interchangeable regardless, so
+// both log-level and log_level set the flag log-level, in all formats. The
+// keys are only written in style s in the default format.
+func WithKeyStyle(s KeyStyle) Option {
+	return func(o *options) {
+		o.keyStyle = s
+	}
+}
+
+// fileKey returns the key or section name as written to the config file, see
+// WithKeyStyle.
+func (o *options) fileKey(name string) string {
+	if o.keyStyle == KeyUnderscore {
+		return strings.ReplaceAll(name, "-", "_")
+	}
+	return name
+}
+
+// DeprecatedPlacement is the location of the obsolete keys not matching any
+// flag, see WithDeprecatedPlacement.
+type DeprecatedPlacement int
+
+const (
+	// DeprecatedBottom keeps the obsolete keys at the end of the config
+	// file, which is the default.
+	DeprecatedBottom DeprecatedPlacement = iota
+	// DeprecatedTop keeps the obsolete keys at the top of the config file,
+	// after the header, so they are noticed immediately.
+	DeprecatedTop
+	// DeprecatedFile keeps the obsolete keys in a separate file next to the
+	// config file, with the additional extension .deprecated, which is
+	// removed once there are no obsolete keys left.
+	DeprecatedFile
+)
+
+// WithDeprecatedPlacement places the obsolete keys of the config file at p.
+// The update warning points to the obsolete keys accordingly, unless its text
+// is customized, see WithUpdateWarningText. This only applies to the default
+// format, while the formats of WithCodec keep their section of obsolete keys.
+// Obsolete keys are applied to flags added for them again from any place.
+func WithDeprecatedPlacement(p DeprecatedPlacement) Option {
+	return func(o *options) {
+		o.deprecated = p
+	}
+}
+
+// WithCommentedObsolete writes the keys of the deprecated section commented
+// out and marked, e.g. "# old=1  (unknown flag, ignored)", so they don't look
+// effective. They are still read back as obsolete keys, and applied to flags
+// added again for them, as long as the mark is kept.
+func WithCommentedObsolete(commented bool) Option {
+	return func(o *options) {
+		o.commentObs = commented
+	}
+}
+
+// WithMaxLineLength fails reading config files with lines longer than n
+// bytes, 1 MB by default, with an error naming the line. Values continued on
+// the next line are limited per line. The limit applies to all formats of
+// this package, codecs of other formats read the file on their own, see
+// WithCodec. A limit below 1 is ignored.
+func WithMaxLineLength(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.maxLine = n
+		}
+	}
+}
+
+// WithOmitDefaults writes flags still at their default value as commented out
+// suggestions, e.g. "# port=8080", keeping the config file short while still
+// documenting all flags. Once such a line is uncommented and changed, the flag
+// is written as usual.
+func WithOmitDefaults(omit bool) Option {
+	return func(o *options) {
+		o.omitDefaults = omit
+	}
+}
+
+// WithSecret marks the flags with the given names as secret. Their values are
+// never written to the config file, instead the text entered by the user is
+// preserved as is. Secret flags missing from the file are written with the
+// placeholder **** as value, unless they are empty, and their defaults are
+// masked the same way. The placeholder is read like any other value, so it
+// must be replaced by the user before the flag is used for real.
+func WithSecret(names ...string) Option {
+	return func(o *options) {
+		if o.secrets == nil {
+			o.secrets = make(map[string]bool)
+		}
+		for _, name := range names {
+			o.secrets[name] = true
+		}
+	}
+}
+
+// defaultCategory holds the flags without category, see WithCategory.
+const defaultCategory = "General"
+
+// WithCategory groups the flag name with the other flags of category in the
+// written config file, under a "# --- category ---" header. Categories are
+// written in the order they were first passed to WithCategory, after the
+// flags without category in the category "General". Within dotted sections,
+// the flags of each section are grouped the same way. Categories only change
+// the layout of the file, not how it is read.
+func WithCategory(name, category string) Option {
+	return func(o *options) {
+		if o.categories == nil {
+			o.categories = make(map[string]int)
+		}
+		i := 0
+		for i < len(o.categoryOrder) && o.categoryOrder[i] != category {
+			i++
+		}
+		if i == len(o.categoryOrder) {
+			o.categoryOrder = append(o.categoryOrder, category)
+		}
+		o.categories[name] = i + 1
+	}
+}
+
+// WithList marks the flags with the given names as lists, typically flags
+// implemented by a flag.Value collecting repeated flags on the command line.
+// Their values in the config file are split at sep, which defaults to a comma,
+// and flag.Value.Set is called once per element, so "tag=a,b,c" is read like
+// -tag=a -tag=b -tag=c. Elements are quoted and escaped like single values, so
+// an element containing sep must be quoted, e.g. tag="a,b",c sets the two
+// elements a,b and c. Empty elements are skipped unless they are quoted.
+//
+// When writing the file, the elements are joined with sep again if the flag's
+// Value is a flag.Getter returning a []string. Otherwise its String method has
+// to return the elements joined with sep.
+func WithList(sep string, names ...string) Option {
+	return func(o *options) {
+		if sep == "" {
+			sep = ","
+		}
+		if o.lists == nil {
+			o.lists = make(map[string]string)
+		}
+		for _, name := range names {
+			o.lists[name] = sep
+		}
+	}
+}
+
+// configPath returns the path of the config file, see getConfigPath.
+func (o *options) configPath() (string, error) {
+	if err := checkAppName(o.appName); err != nil {
+		return "", err
+	} else if o.path != "" {
+		return o.path, nil
+	}
+	return getConfigPath(o.appName, o.envVar, o.format.ext())
+}
+
+// categoryHeader returns the comment introducing the category at position i.
+func (o *options) categoryHeader(i int) string {
+	category := defaultCategory
+	if i > 0 {
+		category = o.categoryOrder[i-1]
+	}
+	return fmt.Sprintf("%s --- %s ---", o.commentPrefix, category)
+}
+
+// isCategoryHeader reports whether the comment line was written by
+// categoryHeader.
+func (o *options) isCategoryHeader(line string) bool {
+	if len(o.categoryOrder) == 0 {
+		return false
+	}
+	for i := 0; i <= len(o.categoryOrder); i++ {
+		if line == o.categoryHeader(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// sortCategories sorts flags by their category, keeping their order within
+// each category.
+func (o *options) sortCategories(flags []flag.Flag) []flag.Flag {
+	sort.SliceStable(flags, func(i, j int) bool {
+		return o.categories[flags[i].Name] < o.categories[flags[j].Name]
+	})
+	return flags
+}
+
+// writeSeparator returns the separator written between keys and values.
+func (o *options) writeSeparator() byte {
+	if o.separator == 0 {
+		return '='
+	}
+	return o.separator
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package confy
+
+import "os"
+
+// reloadSignals are the signals ReloadOnSignal reloads on by default. There is
+// no SIGHUP on this platform, so signals have to be given explicitly.
+var reloadSignals []os.Signal
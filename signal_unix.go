@@ -0,0 +1,11 @@
+//go:build unix
+
+package confy
+
+import (
+	"os"
+	"syscall"
+)
+
+// reloadSignals are the signals ReloadOnSignal reloads on by default.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
@@ -0,0 +1,90 @@
+package confy
+
+import (
+	"flag"
+	"io"
+)
+
+// Source is the origin of the value of a flag, see ParseResult.
+type Source int
+
+// The sources of flag values, in the order of their precedence.
+const (
+	// SourceDefault is the default value of the flag
+	SourceDefault Source = iota
+	// SourceFile is a config file, including base files, includes and
+	// profiles, or a value persisted by ApplyAndPersist
+	SourceFile
+	// SourceEnv is an environment variable
+	SourceEnv
+	// SourceFlag is the command line
+	SourceFlag
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceDefault:
+		return "default"
+	case SourceFile:
+		return "file"
+	case SourceEnv:
+		return "env"
+	case SourceFlag:
+		return "flag"
+	}
+	return "unknown"
+}
+
+// flagSources returns the sources of the values of all flags, given the flags
+// set by the config file, its profile, the environment and the command line.
+// Flags sharing their variable share the source of the flag set last.
+func flagSources(o *options, file, profile, env, args []string) map[string]Source {
+	byKey := make(map[sharedKey]Source)
+	set := func(names []string, s Source) {
+		for _, name := range names {
+			if f := o.fs.Lookup(name); f != nil {
+				byKey[keyOf(f)] = s
+			}
+		}
+	}
+	for name := range o.inherited {
+		set([]string{name}, SourceFile)
+	}
+	for name := range o.seeds {
+		set([]string{name}, SourceFile)
+	}
+	set(file, SourceFile)
+	set(profile, SourceFile)
+	set(env, SourceEnv)
+	set(args, SourceFlag)
+
+	sources := make(map[string]Source)
+	o.fs.VisitAll(func(f *flag.Flag) {
+		sources[f.Name] = byKey[keyOf(f)]
+	})
+	return sources
+}
+
+// argValue records a flag of the command line without setting it.
+type argValue struct{ isBool bool }
+
+func (v argValue) String() string   { return "" }
+func (v argValue) Set(string) error { return nil }
+func (v argValue) IsBoolFlag() bool { return v.isBool }
+
+// commandLineFlags returns the names of the flags of fs set by args. As fs
+// doesn't tell its flags set on the command line from those set before, args
+// are parsed again with flags which don't set anything.
+func commandLineFlags(fs *flag.FlagSet, args []string) []string {
+	scratch := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	scratch.SetOutput(io.Discard)
+	fs.VisitAll(func(f *flag.Flag) {
+		scratch.Var(argValue{isBoolFlag(f)}, f.Name, "")
+	})
+	scratch.Parse(args)
+	var names []string
+	scratch.Visit(func(f *flag.Flag) {
+		names = append(names, f.Name)
+	})
+	return names
+}
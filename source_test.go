@@ -0,0 +1,49 @@
+package confy
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSources(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = []string{os.Args[0], "-port=3", "-v"}
+	defer func() {
+		os.Args = oldArgs
+	}()
+	os.Setenv("CONFY_SOURCE_NAME", "env")
+	defer os.Unsetenv("CONFY_SOURCE_NAME")
+
+	dir, err := ioutil.TempDir("", "confy_test_source")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(cPath, []byte("port=1\nname=file\nhost=file\n# limit=5\n"), 0600); err != nil {
+		t.Fatalf("failed to create config file")
+	}
+
+	fs := flag.NewFlagSet("source", flag.ContinueOnError)
+	port := fs.Int("port", 0, "port")
+	fs.String("name", "", "name")
+	fs.String("host", "", "host")
+	fs.Int("limit", 0, "limit")
+	verbose := fs.Bool("verbose", false, "verbose")
+	fs.BoolVar(verbose, "v", false, "verbose")
+	res, err := ParseDetailed("confy_source", WithPath(cPath), WithFlagSet(fs))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	if *port != 3 || !*verbose {
+		t.Errorf("unexpected values: %d, %v", *port, *verbose)
+	}
+	want := "map[host:file limit:default name:env port:flag v:flag verbose:flag]"
+	if got := fmt.Sprint(res.Sources); got != want {
+		t.Errorf("unexpected sources (want: %s; got: %s)", want, got)
+	}
+}
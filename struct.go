@@ -0,0 +1,78 @@
+package confy
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// LoadInto reads the config file of appName into the fields of the struct v
+// points to, instead of into flags, and writes back an updated config file
+// like ParseWith with opts. The key of a field is given by its confy tag, e.g.
+// `confy:"port"`, the comment written above it by its usage tag, which
+// defaults to the name of the field. Fields without a confy tag are skipped.
+// Fields may be of type string, bool, int, int64, uint, uint64, float64 and
+// time.Duration, their values before calling LoadInto are their defaults.
+// Keys not matching any field are kept in the deprecated section.
+//
+// The environment variables are applied like for flags, the command line is
+// not parsed.
+func LoadInto(appName string, v interface{}, opts ...Option) error {
+	fs, err := structFlags(appName, v)
+	if err != nil {
+		return err
+	}
+	return ParseWith(appName, append(opts, WithFlagSet(fs), func(o *options) {
+		o.noArgs = true
+	})...)
+}
+
+// structFlags returns a flag set with a flag for each tagged field of the
+// struct v points to, which sets the field.
+func structFlags(appName string, v interface{}) (*flag.FlagSet, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("LoadInto needs a pointer to a struct, not %T", v)
+	}
+	rv = rv.Elem()
+	fs := flag.NewFlagSet(appName, flag.ContinueOnError)
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Type().Field(i)
+		name, ok := field.Tag.Lookup("confy")
+		if !ok || name == "" {
+			continue
+		}
+		if !field.IsExported() {
+			return nil, fmt.Errorf("field %s with key %s is not exported", field.Name, name)
+		}
+		if fs.Lookup(name) != nil {
+			return nil, fmt.Errorf("field %s reuses the key %s", field.Name, name)
+		}
+		usage, ok := field.Tag.Lookup("usage")
+		if !ok {
+			usage = field.Name
+		}
+		switch p := rv.Field(i).Addr().Interface().(type) {
+		case *string:
+			fs.StringVar(p, name, *p, usage)
+		case *bool:
+			fs.BoolVar(p, name, *p, usage)
+		case *int:
+			fs.IntVar(p, name, *p, usage)
+		case *int64:
+			fs.Int64Var(p, name, *p, usage)
+		case *uint:
+			fs.UintVar(p, name, *p, usage)
+		case *uint64:
+			fs.Uint64Var(p, name, *p, usage)
+		case *float64:
+			fs.Float64Var(p, name, *p, usage)
+		case *time.Duration:
+			fs.DurationVar(p, name, *p, usage)
+		default:
+			return nil, fmt.Errorf("field %s with key %s has the unsupported type %v", field.Name, name, field.Type)
+		}
+	}
+	return fs, nil
+}
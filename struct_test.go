@@ -0,0 +1,80 @@
+package confy
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadInto(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = []string{os.Args[0], "-unrelated"}
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	dir, err := ioutil.TempDir("", "confy_test_struct")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cPath := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(cPath, []byte("port=8080\ntimeout=5s\nold=1\n"), 0600); err != nil {
+		t.Fatalf("failed to create config file")
+	}
+
+	type config struct {
+		Port    int           `confy:"port"`
+		Name    string        `confy:"name" usage:"the name"`
+		Debug   bool          `confy:"debug"`
+		Timeout time.Duration `confy:"timeout"`
+		Skipped int
+	}
+	for i := 0; i < 2; i++ {
+		c := config{Port: 80, Name: "app", Skipped: 1}
+		if err := LoadInto("confy_struct", &c, WithPath(cPath), WithUpdateWarning(false)); err != nil {
+			t.Fatalf("unexpected error occurred: %v", err)
+		}
+		if c != (config{8080, "app", false, 5 * time.Second, 1}) {
+			t.Errorf("run %d: unexpected values: %+v", i, c)
+		}
+	}
+	want := `
+# Port (int, default 80)
+port=8080
+
+# Timeout (duration, default 0s)
+timeout=5s
+
+# Debug (bool, default false)
+debug=false
+
+# the name (string, default app)
+name=app
+
+
+# The following options are probably deprecated and not used currently!
+old=1
+`
+	if b, _ := ioutil.ReadFile(cPath); !strings.HasSuffix(string(b), want) {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, b)
+	}
+	if flag.CommandLine.Lookup("port") != nil {
+		t.Errorf("the fields must not be registered as flags")
+	}
+
+	var c config
+	if err := LoadInto("confy_struct", c, WithPath(cPath)); err == nil {
+		t.Errorf("expected an error for a struct value")
+	}
+	var unsupported struct {
+		Ports []int `confy:"ports"`
+	}
+	if err := LoadInto("confy_struct", &unsupported, WithPath(cPath)); err == nil || !strings.Contains(err.Error(), "unsupported type []int") {
+		t.Errorf("expected an error for an unsupported field, got: %v", err)
+	}
+}
@@ -0,0 +1,322 @@
+package confy
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// tomlDeprecated is the table holding the obsolete keys in TOML config files.
+const tomlDeprecated = "_deprecated"
+
+// ParseTOML is like Parse but the config file is written in TOML. Tables map
+// to dotted flag names, e.g. host = "x" in the table [db] sets the flag
+// db.host. Only strings, numbers, booleans and dates are supported as values,
+// not arrays, inline tables or multi-line strings. The file is located like
+// the default config file, but with the extension .toml. Keys not matching any
+// flag are preserved in the table [_deprecated].
+func ParseTOML(appName string) error {
+	return ParseCodec(appName, tomlCodec{})
+}
+
+// tomlCodec reads and writes config files in TOML.
+type tomlCodec struct{}
+
+func (tomlCodec) Extension() string {
+	return ".toml"
+}
+
+func (c tomlCodec) Decode(r io.Reader) (map[string]string, error) {
+	return c.decodeLimited(r, defaultMaxLine)
+}
+
+func (tomlCodec) decodeLimited(r io.Reader, max int) (map[string]string, error) {
+	values, deprecated := make(map[string]string), make(map[string]string)
+
+	var errs []error
+	table, lineNum := "", 0
+	scanner := newLineScanner(r, max)
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if lineNum == 1 {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[[") {
+			errs = append(errs, fmt.Errorf("line %d: arrays of tables are not supported", lineNum))
+			continue
+		} else if strings.HasPrefix(line, "[") {
+			keys, rest, err := tomlKey(line[1:])
+			if err == nil && !strings.HasPrefix(rest, "]") {
+				err = fmt.Errorf("missing ] after table name")
+			} else if err == nil {
+				err = tomlRest(rest[1:])
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("line %d: %w", lineNum, err))
+				continue
+			}
+			table = strings.Join(keys, ".")
+			continue
+		}
+
+		keys, rest, err := tomlKey(line)
+		if err == nil && !strings.HasPrefix(rest, "=") {
+			err = fmt.Errorf("missing = after key")
+		}
+		var val string
+		if err == nil {
+			if val, rest, err = tomlValue(strings.TrimSpace(rest[1:])); err == nil {
+				err = tomlRest(rest)
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", lineNum, err))
+			continue
+		}
+		key := strings.Join(keys, ".")
+		if table == tomlDeprecated {
+			deprecated[key] = val
+			continue
+		} else if table != "" {
+			key = table + "." + key
+		}
+		values[key] = val
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, scanError(err, lineNum, max)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return withDeprecated(values, deprecated), nil
+}
+
+// tomlKey parses the possibly dotted and quoted key at the start of s and
+// returns its parts and the rest of s after the key.
+func tomlKey(s string) ([]string, string, error) {
+	var keys []string
+	for {
+		s = strings.TrimSpace(s)
+		var key string
+		var err error
+		switch {
+		case strings.HasPrefix(s, `"`), strings.HasPrefix(s, "'"):
+			if key, s, err = tomlValue(s); err != nil {
+				return nil, "", err
+			}
+		default:
+			n := 0
+			for n < len(s) && isBareKey(s[n]) {
+				n++
+			}
+			if n == 0 {
+				return nil, "", fmt.Errorf("missing key")
+			}
+			key, s = s[:n], s[n:]
+		}
+		keys = append(keys, key)
+
+		s = strings.TrimSpace(s)
+		if !strings.HasPrefix(s, ".") {
+			return keys, s, nil
+		}
+		s = s[1:]
+	}
+}
+
+func isBareKey(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// tomlValue parses the value at the start of s and returns it in the string
+// form accepted by flag.Value.Set together with the rest of s.
+func tomlValue(s string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(s, `"""`), strings.HasPrefix(s, "'''"):
+		return "", "", fmt.Errorf("multi-line strings are not supported")
+	case strings.HasPrefix(s, "["), strings.HasPrefix(s, "{"):
+		return "", "", fmt.Errorf("arrays and inline tables are not supported")
+	case strings.HasPrefix(s, "'"):
+		end := strings.Index(s[1:], "'")
+		if end == -1 {
+			return "", "", fmt.Errorf("unterminated string %s", s)
+		}
+		return s[1 : end+1], s[end+2:], nil
+	case strings.HasPrefix(s, `"`):
+		return tomlBasicString(s)
+	}
+
+	// numbers, booleans and dates are passed on as written
+	end := strings.Index(s, "#")
+	if end == -1 {
+		end = len(s)
+	}
+	val := strings.TrimSpace(s[:end])
+	if val == "" {
+		return "", "", fmt.Errorf("missing value")
+	}
+	return val, s[end:], nil
+}
+
+// tomlBasicString decodes the double quoted string at the start of s.
+func tomlBasicString(s string) (string, string, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), s[i+1:], nil
+		case '\\':
+			if i+1 == len(s) {
+				return "", "", fmt.Errorf("unterminated string %s", s)
+			}
+			i++
+			switch s[i] {
+			case 'b':
+				b.WriteByte('\b')
+			case 't':
+				b.WriteByte('\t')
+			case 'n':
+				b.WriteByte('\n')
+			case 'f':
+				b.WriteByte('\f')
+			case 'r':
+				b.WriteByte('\r')
+			case '"', '\\':
+				b.WriteByte(s[i])
+			case 'u', 'U':
+				n := 4
+				if s[i] == 'U' {
+					n = 8
+				}
+				if i+n >= len(s) {
+					return "", "", fmt.Errorf("invalid escape sequence in %s", s)
+				}
+				r, err := strconv.ParseUint(s[i+1:i+1+n], 16, 32)
+				if err != nil || !utf8.ValidRune(rune(r)) {
+					return "", "", fmt.Errorf("invalid escape sequence in %s", s)
+				}
+				b.WriteRune(rune(r))
+				i += n
+			default:
+				return "", "", fmt.Errorf("invalid escape sequence \\%c in %s", s[i], s)
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string %s", s)
+}
+
+// tomlRest checks that only whitespace or a comment follows a key or value.
+func tomlRest(rest string) error {
+	if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+		return fmt.Errorf("unexpected %s", rest)
+	}
+	return nil
+}
+
+func (tomlCodec) Encode(w io.Writer, flags []flag.Flag, obsolete map[string]string) error {
+	var b strings.Builder
+	sections, grouped := groupSections(flags)
+	for _, section := range sections {
+		if section != "" {
+			fmt.Fprintf(&b, "\n[%s]\n", tomlKeyString(section))
+		}
+		for _, f := range grouped[section] {
+			_, key := splitSection(f.Name)
+			fmt.Fprintf(&b, "\n%s\n%s = %s\n", commentLines("#", usageText(&f)), tomlKeyString(key), tomlValueString(typedValue(&f)))
+		}
+	}
+
+	if len(obsolete) > 0 {
+		fmt.Fprintf(&b, "\n\n# %s\n[%s]\n", obsoleteBanner, tomlDeprecated)
+		for _, key := range sortedKeys(obsolete) {
+			fmt.Fprintf(&b, "%s = %s\n", tomlQuote(key), tomlQuote(obsolete[key]))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// tomlKeyString returns key as bare, possibly dotted key if possible or as
+// quoted key otherwise.
+func tomlKeyString(key string) string {
+	for _, part := range strings.Split(key, ".") {
+		if part == "" {
+			return tomlQuote(key)
+		}
+		for i := 0; i < len(part); i++ {
+			if !isBareKey(part[i]) {
+				return tomlQuote(key)
+			}
+		}
+	}
+	return key
+}
+
+// tomlValueString encodes the typed value val, see typedValue.
+func tomlValueString(val interface{}) string {
+	switch v := val.(type) {
+	case bool:
+		return strconv.FormatBool(v)
+	case int, int64, uint, uint64:
+		return fmt.Sprint(v)
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			return "nan"
+		case math.IsInf(v, 1):
+			return "inf"
+		case math.IsInf(v, -1):
+			return "-inf"
+		}
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".e") {
+			s += ".0"
+		}
+		return s
+	}
+	return tomlQuote(fmt.Sprint(val))
+}
+
+// tomlQuote encodes s as TOML basic string.
+func tomlQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
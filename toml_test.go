@@ -0,0 +1,127 @@
+package confy
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseTOML(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	f, err := ioutil.TempFile("", "confy_testtoml")
+	if err != nil {
+		t.Fatalf("failed to create tempfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`# comment
+name = 'C:\path' # literal
+verbose = true
+old = 1
+
+[db]
+host = "db.example.com\t\u00e4"
+"port" = 5_432
+
+[log]
+rotate.every = 1h
+
+[_deprecated]
+"older" = "x"
+`)
+	f.Close()
+	os.Setenv("CONFY_TOMLINF0", f.Name())
+	defer os.Unsetenv("CONFY_TOMLINF0")
+
+	newFlags := func() {
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		flag.String("name", "", "name")
+		flag.Bool("verbose", false, "verbose")
+		flag.String("db.host", "", "database host")
+		flag.Int("db.port", 0, "database port")
+		flag.Duration("log.rotate.every", time.Minute, "rotation")
+		flag.Float64("ratio", 1, "ratio")
+	}
+	newFlags()
+	if err := ParseWith("confy_toml", WithCodec(tomlCodec{}), WithUpdateWarning(false)); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	for name, want := range map[string]string{
+		"name":             `C:\path`,
+		"verbose":          "true",
+		"db.host":          "db.example.com\tä",
+		"db.port":          "5432",
+		"log.rotate.every": "1h0m0s",
+	} {
+		if got := flag.Lookup(name).Value.String(); got != want {
+			t.Errorf("%s: (want: %q; got: %q)", name, want, got)
+		}
+	}
+
+	want := `
+# name (string, default )
+name = "C:\\path"
+
+# ratio (float, default 1)
+ratio = 1.0
+
+# verbose (bool, default false)
+verbose = true
+
+[db]
+
+# database host (string, default )
+host = "db.example.com\tä"
+
+# database port (int, default 0)
+port = 5432
+
+[log]
+
+# rotation (duration, default 1m)
+rotate.every = "1h"
+
+
+# The following options are probably deprecated and not used currently!
+[_deprecated]
+"old" = "1"
+"older" = "x"
+`
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil || string(b) != want {
+		t.Errorf("unexpected result:\nWANT:\n%s\n\nGOT:\n%s\n", want, b)
+	}
+
+	// the rewritten file is stable
+	newFlags()
+	res, err := ParseDetailed("confy_toml", WithCodec(tomlCodec{}), WithUpdateWarning(false))
+	if err != nil || res.Changed {
+		t.Errorf("unexpected rewrite: %v, %v", res.Changed, err)
+	}
+}
+
+func TestTOMLErrors(t *testing.T) {
+	for _, file := range []string{
+		`a = [1, 2]`,
+		`a = {b = 1}`,
+		`a = """x"""`,
+		`a = "x`,
+		`a = "\x"`,
+		`a "x"`,
+		`= "x"`,
+		`a = "x" y`,
+		`[[a]]`,
+		`[a`,
+	} {
+		if _, err := (tomlCodec{}).Decode(bytes.NewBufferString(file)); err == nil {
+			t.Errorf("expected an error for %s", file)
+		}
+	}
+}
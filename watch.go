@@ -0,0 +1,214 @@
+package confy
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchInterval is the interval in which Watch checks the config file.
+var watchInterval = time.Second
+
+// Watch reloads the config file of appName whenever its modification time or
+// size changes, until stop is called. The file is located as by ParseWith
+// with opts, but it is never written. After each reload, the environment
+// variables and the command line are applied again, so they keep their
+// precedence, and onReload is called with the error of the reload, if any.
+// The flags are reset to their defaults before each reload, so flags removed
+// from the file get their defaults back and repeatable flags like lists don't
+// accumulate the values of all reloads. Base files are applied again, too.
+//
+// Reloading sets the flags from another goroutine. This is only safe for
+// flag.Value implementations synchronizing access themselves. The values of
+// the standard flags, like the variables of flag.Int, must not be accessed
+// concurrently by the application. Instead, onReload, which is called on the
+// goroutine setting the flags, may copy them where the application can access
+// them safely, e.g. under a mutex of its own.
+func Watch(appName string, onReload func(error), opts ...Option) (stop func(), err error) {
+	o := newOptions(appName, opts)
+	cPath, err := o.configPath()
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(cPath)
+	if err != nil {
+		return nil, tagError(ErrOpen, fmt.Errorf("unable to watch %s config file %v: %w", appName, cPath, err))
+	}
+
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+
+		// errors are only reported once until the file is back
+		modTime, size, failed := fi.ModTime(), fi.Size(), false
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			fi, err := os.Stat(cPath)
+			if err != nil {
+				if !failed && onReload != nil {
+					onReload(fmt.Errorf("unable to watch %s config file %v: %w", appName, cPath, err))
+				}
+				failed = true
+				continue
+			}
+			if !failed && fi.ModTime().Equal(modTime) && fi.Size() == size {
+				continue
+			}
+			modTime, size, failed = fi.ModTime(), fi.Size(), false
+			err = reload(o, cPath)
+			if onReload != nil {
+				onReload(err)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}, nil
+}
+
+// ReloadOnSignal reloads the config file of appName into the flags of
+// flag.CommandLine whenever one of the signals sig arrives, SIGHUP by default,
+// until stop is called. See ReloadOnSignalWith. On platforms without SIGHUP,
+// like Windows, sig must be given, otherwise a warning is written and nothing
+// is reloaded.
+func ReloadOnSignal(appName string, sig ...os.Signal) (stop func()) {
+	return ReloadOnSignalWith(appName, nil, sig...)
+}
+
+// ReloadOnSignalWith is like ReloadOnSignal but its behaviour can be
+// customized with opts like ParseWith. As with Watch, the environment
+// variables and the command line are applied again after the file and the
+// file is never written. Errors are written to the logger, see WithLogger.
+// The same restrictions for accessing the flags concurrently apply as for
+// Watch.
+func ReloadOnSignalWith(appName string, opts []Option, sig ...os.Signal) (stop func()) {
+	o := newOptions(appName, opts)
+	if len(sig) == 0 {
+		sig = reloadSignals
+	}
+	// signal.Notify without signals would relay all of them
+	if len(sig) == 0 {
+		o.log.Printf("WARNING: no signal to reload the %s config on, SIGHUP is not supported on %s\n", appName, goos)
+		return func() {}
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sig...)
+
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-c:
+			}
+			cPath, err := o.configPath()
+			if err == nil {
+				err = reload(o, cPath)
+			}
+			if err != nil {
+				o.log.Printf("WARNING: failed to reload the %s config: %v\n", appName, err)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(c)
+			close(done)
+			<-stopped
+		})
+	}
+}
+
+// reload resets the flags to their defaults, applies the base files, the
+// config file at cPath, the environment variables and the command line to
+// them again and checks them like ParseWith.
+func reload(o *options, cPath string) error {
+	parseMu.Lock()
+	defer parseMu.Unlock()
+
+	if err := resetFlags(o); err != nil {
+		return err
+	}
+	o.inherited = nil
+	if _, err := applyBaseFiles(o); err != nil {
+		return err
+	}
+	f, err := o.openFile(cPath, os.O_RDONLY, 0)
+	if err != nil {
+		return tagError(ErrOpen, fmt.Errorf("unable to open %s config file %v for reading: %w", o.appName, cPath, err))
+	}
+	defer closeFile(f)
+	if err := o.checkFile(cPath, f); err != nil {
+		return err
+	}
+
+	o.path = cPath
+	r, _, err := decompress(f, cPath)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s:\n%w", cPath, err)
+	}
+	conf, err := o.format.parse(o, r)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s:\n%w", cPath, err)
+	}
+	if _, err := applyProfile(o, conf); err != nil {
+		return err
+	}
+	if _, err := applyEnv(o); err != nil {
+		return err
+	}
+	if err := o.fs.Parse(os.Args[1:]); err != nil {
+		return err
+	}
+	return checkFlags(o)
+}
+
+// resetFlags sets the flags back to their defaults. Flags collecting repeated
+// values in a slice, like lists, are emptied first, otherwise setting the
+// default would only add to their elements. Flags showing their default are
+// skipped, so flag.Func and similar flags aren't called needlessly.
+func resetFlags(o *options) error {
+	var errs []error
+	o.fs.VisitAll(func(f *flag.Flag) {
+		if f.Value.String() == f.DefValue {
+			return
+		}
+		elems := []string{f.DefValue}
+		if v := reflect.ValueOf(f.Value); v.Kind() == reflect.Ptr && v.Elem().Kind() == reflect.Slice {
+			v.Elem().Set(reflect.Zero(v.Elem().Type()))
+			if sep, ok := o.lists[f.Name]; ok && f.DefValue != "" {
+				elems = strings.Split(f.DefValue, sep)
+			} else if f.DefValue == "" {
+				elems = nil
+			}
+		}
+		for _, elem := range elems {
+			if err := f.Value.Set(elem); err != nil {
+				errs = append(errs, fmt.Errorf("unable to reset %s to its default %q: %w", f.Name, f.DefValue, err))
+				return
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
@@ -0,0 +1,123 @@
+package confy
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = []string{os.Args[0], "-name=cli"}
+	defer func() {
+		os.Args = oldArgs
+	}()
+	watchInterval = 10 * time.Millisecond
+	defer func() {
+		watchInterval = time.Second
+	}()
+
+	f, err := ioutil.TempFile("", "confy_testwatch")
+	if err != nil {
+		t.Fatalf("failed to create tempfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("port=1\nname=file\n")
+	f.Close()
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	port := fs.Int("port", 0, "port")
+	name := fs.String("name", "", "name")
+	// the values are copied on the goroutine setting them, as documented
+	type values struct {
+		port int
+		name string
+		err  error
+	}
+	reloaded := make(chan values, 10)
+	stop, err := Watch("confy_watch", func(err error) {
+		reloaded <- values{*port, *name, err}
+	}, WithFlagSet(fs), WithPath(f.Name()))
+	if err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	defer stop()
+
+	if err := ioutil.WriteFile(f.Name(), []byte("port=22\nname=file\n"), 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", f.Name(), err)
+	}
+	// the file may be reloaded while it is written, so wait for the values
+	for v := (values{}); v.port != 22; {
+		select {
+		case v = <-reloaded:
+			if v.err != nil {
+				t.Fatalf("unexpected error occurred: %v", v.err)
+			} else if v.name != "cli" {
+				t.Errorf("name: (want: %q; got: %q)", "cli", v.name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("config file was not reloaded")
+		}
+	}
+
+	if err := ioutil.WriteFile(f.Name(), []byte("port=x\n"), 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", f.Name(), err)
+	}
+	for v := (values{}); v.err == nil; {
+		select {
+		case v = <-reloaded:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected an error for an invalid value")
+		}
+	}
+
+	stop()
+	stop()
+	if _, err := Watch("confy_watch", nil, WithPath(f.Name()+".missing")); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
+
+func TestReloadResetsFlags(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = []string{os.Args[0], "-tag=z"}
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	f, err := ioutil.TempFile("", "confy_testreload")
+	if err != nil {
+		t.Fatalf("failed to create tempfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("path=a,b\nport=1\n")
+	f.Close()
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	var tags, paths listValue
+	fs.Var(&tags, "tag", "tags")
+	fs.Var(&paths, "path", "paths")
+	port := fs.Int("port", 8, "port")
+	o := newOptions("confy_reload", []Option{WithFlagSet(fs), WithPath(f.Name()), WithList(",", "path")})
+	for i := 0; i < 2; i++ {
+		if err := reload(o, f.Name()); err != nil {
+			t.Fatalf("unexpected error occurred: %v", err)
+		}
+	}
+	if tags.String() != "z" || paths.String() != "a,b" || *port != 1 {
+		t.Errorf("unexpected values after reloading twice: tag=%s path=%s port=%d", tags.String(), paths.String(), *port)
+	}
+
+	if err := ioutil.WriteFile(f.Name(), []byte("path=c,d\n"), 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", f.Name(), err)
+	}
+	if err := reload(o, f.Name()); err != nil {
+		t.Fatalf("unexpected error occurred: %v", err)
+	}
+	// flags removed from the file get their defaults back
+	if tags.String() != "z" || paths.String() != "c,d" || *port != 8 {
+		t.Errorf("unexpected values after editing the file: tag=%s path=%s port=%d", tags.String(), paths.String(), *port)
+	}
+}
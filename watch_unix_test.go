@@ -0,0 +1,84 @@
+//go:build unix
+
+package confy
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// chanValue is a flag.Value reporting each Set call on a channel.
+type chanValue chan string
+
+func (v chanValue) String() string {
+	return ""
+}
+
+func (v chanValue) Set(val string) error {
+	v <- val
+	return nil
+}
+
+// chanLogger is a Logger reporting each message on a channel.
+type chanLogger chan string
+
+func (l chanLogger) Printf(format string, v ...interface{}) {
+	l <- fmt.Sprintf(format, v...)
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = os.Args[:1]
+	defer func() {
+		os.Args = oldArgs
+	}()
+
+	f, err := ioutil.TempFile("", "confy_testsignal")
+	if err != nil {
+		t.Fatalf("failed to create tempfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("value=1\n")
+	f.Close()
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	value, logged := make(chanValue, 1), make(chanLogger, 1)
+	fs.Var(value, "value", "value")
+	stop := ReloadOnSignalWith("confy_signal", []Option{WithFlagSet(fs), WithPath(f.Name()), WithLogger(logged)}, syscall.SIGUSR1)
+	defer stop()
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatalf("failed to send signal: %v", err)
+	}
+	select {
+	case val := <-value:
+		if val != "1" {
+			t.Errorf("value: (want: %q; got: %q)", "1", val)
+		}
+	case msg := <-logged:
+		t.Fatalf("unexpected error occurred: %s", msg)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("config file was not reloaded")
+	}
+
+	os.Remove(f.Name())
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatalf("failed to send signal: %v", err)
+	}
+	select {
+	case msg := <-logged:
+		if !strings.HasPrefix(msg, "WARNING: failed to reload the confy_signal config") {
+			t.Errorf("unexpected message: %s", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("reload error was not logged")
+	}
+	stop()
+	stop()
+}